@@ -1,40 +1,274 @@
 package main
 
 import (
+	"alin/packages/session"
 	"alin/packages/shopify"
+	"alin/packages/shopify/data_handling"
 	"context"
+	"errors"
 	"fmt"
-	"net/http"
-	"net/http/httputil"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 // App struct
 type App struct {
-	ctx context.Context
+	ctx         context.Context
+	tasks       *shopify.TaskManager
+	vault       *data_handling.Vault
+	logging     session.LogConfig
+	loggingPath string
 }
 
+// Profiles lock again after this long without use
+const vaultIdleTimeout = 15 * time.Minute
+
 // NewApp creates a new App application struct
 func NewApp() *App {
-	return &App{}
+	store, err := shopify.DefaultTaskStore()
+	if err != nil {
+		println("Error opening task store:", err.Error())
+	}
+	vault, err := data_handling.DefaultVault(vaultIdleTimeout)
+	if err != nil {
+		println("Error finding app data directory, keeping profiles next to the app:", err.Error())
+		vault = data_handling.NewVault("profiles.vault", vaultIdleTimeout)
+	}
+	loggingPath, logging := loadLogConfig()
+	checkpoints, err := data_handling.AppDataPath("checkpoints")
+	if err != nil {
+		println("Error finding app data directory, checkouts won't resume after a restart:", err.Error())
+		checkpoints = ""
+	}
+
+	return &App{
+		tasks: shopify.NewTaskManager(shopify.TaskManagerConfig{
+			MaxConcurrent: 50,
+			MaxPerStore:   20,
+			Store:         store,
+			Profiles:      vault,
+			Logging:       logging,
+			Checkpoints:   checkpoints,
+		}),
+		vault:       vault,
+		logging:     logging,
+		loggingPath: loggingPath,
+	}
 }
 
-func main() {
-	resp, err := http.Get("https://api.ipify.org?format=json")
+// loadLogConfig reads logging.json from the app data directory. Task files go in a logs directory beside it.
+func loadLogConfig() (string, session.LogConfig) {
+	path, err := data_handling.AppDataPath("logging.json")
 	if err != nil {
+		println("Error finding app data directory, using the default log config:", err.Error())
+		return "", session.DefaultLogConfig()
 	}
-	respDump, err := httputil.DumpResponse(resp, true)
-	fmt.Printf("[GET] Resp: %s", respDump)
-
-	shopify.Test()
+	logging, err := session.LoadLogConfig(path)
+	if err != nil {
+		println("Error loading log config:", err.Error())
+	}
+	if logging.Dir == "" {
+		logging.Dir = filepath.Join(filepath.Dir(path), "logs")
+	}
+	return path, logging
 }
 
 // startup is called when the app starts. The context is saved
 // , so we can call the runtime methods
 func (a *App) startup(ctx context.Context) {
 	a.ctx = ctx
+
+	if err := a.tasks.Load(); err != nil {
+		println("Error loading tasks:", err.Error())
+	}
+}
+
+// shutdown is called when the app is closing. Running tasks get a few seconds to stop.
+func (a *App) shutdown(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	a.tasks.Shutdown(ctx)
+	a.vault.Lock()
 }
 
 // Greet returns a greeting for the given name
 func (a *App) Greet(name string) string {
 	return fmt.Sprintf("Hello %s, It's show time!", name)
 }
+
+// ValidateOptions returns every field-level problem with the task options, so the
+// form can highlight them before a task is created
+func (a *App) ValidateOptions(options data_handling.Options) []data_handling.FieldError {
+	err := options.Validate()
+
+	var errs data_handling.ValidationErrors
+	if errors.As(err, &errs) {
+		return errs
+	}
+	return []data_handling.FieldError{}
+}
+
+// CreateTask adds an idle task and returns its ID
+func (a *App) CreateTask(options data_handling.Options) (int, error) {
+	return a.tasks.Create(options)
+}
+
+func (a *App) StartTask(id int) error {
+	return a.tasks.Start(id)
+}
+
+func (a *App) StopTask(id int) error {
+	return a.tasks.Stop(id)
+}
+
+func (a *App) RestartTask(id int) error {
+	return a.tasks.Restart(id)
+}
+
+func (a *App) DeleteTask(id int) error {
+	return a.tasks.Delete(id)
+}
+
+// ListTasks returns every task with its current status, ordered by ID
+func (a *App) ListTasks() []shopify.TaskInfo {
+	return a.tasks.List()
+}
+
+// TaskHistory returns the status transitions of a task's current run
+func (a *App) TaskHistory(id int) ([]shopify.Status, error) {
+	return a.tasks.History(id)
+}
+
+// CreateGroup adds an empty task group, e.g. one per release
+func (a *App) CreateGroup(name string) (int, error) {
+	return a.tasks.CreateGroup(name)
+}
+
+func (a *App) AddToGroup(groupID int, taskIDs []int) error {
+	return a.tasks.AddToGroup(groupID, taskIDs...)
+}
+
+func (a *App) RemoveFromGroup(taskIDs []int) {
+	a.tasks.RemoveFromGroup(taskIDs...)
+}
+
+func (a *App) ListGroups() []shopify.TaskGroup {
+	return a.tasks.Groups()
+}
+
+func (a *App) StartGroup(groupID int) error {
+	return a.tasks.StartGroup(groupID)
+}
+
+func (a *App) StopGroup(groupID int) error {
+	return a.tasks.StopGroup(groupID)
+}
+
+// DeleteGroup deletes the group and every task in it
+func (a *App) DeleteGroup(groupID int) error {
+	return a.tasks.DeleteGroup(groupID)
+}
+
+// CloneGroup copies the group and its tasks, returning the new group's ID
+func (a *App) CloneGroup(groupID int, name string) (int, error) {
+	return a.tasks.CloneGroup(groupID, name)
+}
+
+// EditGroup changes the URL, sizes or schedule of every task in the group
+func (a *App) EditGroup(groupID int, edit shopify.GroupEdit) error {
+	return a.tasks.EditGroup(groupID, edit)
+}
+
+// VaultExists reports whether a profile vault has been created yet
+func (a *App) VaultExists() bool {
+	return a.vault.Exists()
+}
+
+func (a *App) CreateVault(passphrase string) error {
+	return a.vault.Create(passphrase)
+}
+
+func (a *App) UnlockVault(passphrase string) error {
+	return a.vault.Unlock(passphrase)
+}
+
+func (a *App) LockVault() {
+	a.vault.Lock()
+}
+
+func (a *App) VaultLocked() bool {
+	return a.vault.Locked()
+}
+
+// ListProfiles returns every profile with card numbers masked
+func (a *App) ListProfiles() ([]data_handling.CheckoutProfile, error) {
+	return a.vault.List()
+}
+
+func (a *App) AddProfile(profile data_handling.CheckoutProfile) error {
+	return a.vault.Add(profile)
+}
+
+// UpdateProfile replaces a profile. Leaving the masked card number as is keeps the stored card.
+func (a *App) UpdateProfile(name string, profile data_handling.CheckoutProfile) error {
+	return a.vault.Update(name, profile)
+}
+
+func (a *App) DeleteProfile(name string) error {
+	return a.vault.Delete(name)
+}
+
+// ProfileImportColumns lists the columns of a profile file with a suggested
+// mapping, so the user can confirm it before importing
+func (a *App) ProfileImportColumns(data string, format data_handling.ProfileFormat) (data_handling.ColumnMapping, error) {
+	columns, err := data_handling.ReadColumns(strings.NewReader(data), format)
+	if err != nil {
+		return nil, err
+	}
+	mapping := data_handling.SuggestMapping(columns)
+	for _, column := range columns {
+		if _, ok := mapping[column]; !ok {
+			// Unmapped columns are shown so the user can pick a target for them
+			mapping[column] = ""
+		}
+	}
+	return mapping, nil
+}
+
+// ImportProfiles adds the profiles in data to the vault, reporting bad rows and duplicates
+func (a *App) ImportProfiles(passphrase string, data string, format data_handling.ProfileFormat, mapping data_handling.ColumnMapping) (data_handling.ImportResult, error) {
+	// Columns the user left unmapped
+	for column, target := range mapping {
+		if target == "" {
+			delete(mapping, column)
+		}
+	}
+	return a.vault.ImportProfiles(passphrase, strings.NewReader(data), format, mapping)
+}
+
+// ExportProfiles returns every profile as CSV or JSON. Card numbers are masked unless includeSecrets is set.
+func (a *App) ExportProfiles(passphrase string, format data_handling.ProfileFormat, includeSecrets bool) (string, error) {
+	var out strings.Builder
+	if err := a.vault.ExportProfiles(passphrase, &out, format, includeSecrets); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// LogConfig returns the current log config
+func (a *App) LogConfig() session.LogConfig {
+	return a.logging
+}
+
+// SetLogConfig saves the log config. Tasks pick it up when next started.
+func (a *App) SetLogConfig(config session.LogConfig) error {
+	if err := a.tasks.SetLogging(config); err != nil {
+		return err
+	}
+	a.logging = config
+	if a.loggingPath == "" {
+		return errors.New("No app data directory to save the log config in")
+	}
+	return session.SaveLogConfig(a.loggingPath, config)
+}
@@ -0,0 +1,79 @@
+package session
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// SetCookies is the cookies one response set and the URL it was for
+type SetCookies struct {
+	URL     string         `json:"url"`
+	Cookies []*http.Cookie `json:"cookies"`
+}
+
+// cookieJar is a cookiejar.Jar that remembers every cookie set on it, which the
+// jar itself can't list, so the cookies can be saved and set on a new jar later
+type cookieJar struct {
+	*cookiejar.Jar
+	mu  sync.Mutex
+	set []SetCookies
+}
+
+func newCookieJar() (*cookieJar, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &cookieJar{Jar: jar}, nil
+}
+
+func (j *cookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.Jar.SetCookies(u, cookies)
+
+	saved := SetCookies{URL: u.String(), Cookies: make([]*http.Cookie, len(cookies))}
+	now := time.Now()
+	for i, cookie := range cookies {
+		c := *cookie
+		// Max-Age counts from when the cookie was set, not when it's restored
+		if c.MaxAge > 0 {
+			c.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+			c.MaxAge = 0
+		}
+		saved.Cookies[i] = &c
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.set = append(j.set, saved)
+}
+
+// SavedCookies returns every cookie the session has been given, oldest first, for RestoreCookies
+func (s *Session) SavedCookies() []SetCookies {
+	if s.jar == nil {
+		return nil
+	}
+	s.jar.mu.Lock()
+	defer s.jar.mu.Unlock()
+	return append([]SetCookies(nil), s.jar.set...)
+}
+
+// RestoreCookies replaces the session's cookies with ones saved from SavedCookies,
+// dropping any that have since expired. nil clears them.
+func (s *Session) RestoreCookies(saved []SetCookies) error {
+	jar, err := newCookieJar()
+	if err != nil {
+		return err
+	}
+	for _, set := range saved {
+		u, err := url.Parse(set.URL)
+		if err != nil {
+			return err
+		}
+		jar.SetCookies(u, set.Cookies)
+	}
+	s.jar = jar
+	s.client.Jar = jar
+	return nil
+}
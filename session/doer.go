@@ -0,0 +1,35 @@
+package session
+
+import "net/http"
+
+// Doer sends a request and returns its response, like *http.Client. Every request
+// a Session sends goes through one, so a fake Doer stands in for the network in tests.
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// DoerFunc lets a function be used as a Doer
+type DoerFunc func(req *http.Request) (*http.Response, error)
+
+func (f DoerFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Middleware wraps a Doer, e.g. to log, count or change requests and responses
+type Middleware func(next Doer) Doer
+
+// Use adds middleware to every request the session sends. The first added sees
+// requests first. Middleware wraps a whole request, redirects included, while
+// retries, host limits and recording apply to each try underneath it.
+func (s *Session) Use(middleware ...Middleware) {
+	s.middleware = append(s.middleware, middleware...)
+	s.rebuild()
+}
+
+// SetDoer replaces the client requests are sent with, e.g. with a fake in tests.
+// Middleware still applies, but retries, host limits, decoding and recording are
+// part of the client and don't. nil goes back to the session's own client.
+func (s *Session) SetDoer(doer Doer) {
+	s.doer = doer
+	s.rebuild()
+}
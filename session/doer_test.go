@@ -0,0 +1,45 @@
+package session
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"alin/packages/shopify/data_handling"
+)
+
+func TestSetDoer(t *testing.T) {
+	s := NewSession(data_handling.Options{}, nil)
+	var order []string
+	s.Use(func(next Doer) Doer {
+		return DoerFunc(func(req *http.Request) (*http.Response, error) {
+			order = append(order, "middleware")
+			return next.Do(req)
+		})
+	})
+	// A fake that builds its response by hand, without a Request
+	s.SetDoer(DoerFunc(func(req *http.Request) (*http.Response, error) {
+		order = append(order, "doer")
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("ok"))}, nil
+	}))
+
+	req, _ := http.NewRequest(http.MethodGet, "https://shop.example.com/checkouts/c/abc", nil)
+	resp, err := s.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if strings.Join(order, ",") != "middleware,doer" {
+		t.Errorf("sent through %v, want the middleware then the doer", order)
+	}
+	if resp.Request != req {
+		t.Fatal("response has no request")
+	}
+	if landed := Landed(resp); landed != req.URL.String() {
+		t.Errorf("landed on %q", landed)
+	}
+	if err := CheckStatus(resp, http.StatusCreated); err == nil || !strings.Contains(err.Error(), "GET") {
+		t.Errorf("status error %v doesn't name the request", err)
+	}
+}
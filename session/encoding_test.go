@@ -0,0 +1,106 @@
+package session
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"alin/packages/shopify/data_handling"
+	"github.com/andybalholm/brotli"
+)
+
+const encodedPage = `<script>Shopify.Checkout.token = "c0ffee";</script>`
+
+func compress(t *testing.T, encoding string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip", "x-gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	default:
+		return []byte(encodedPage)
+	}
+	io.WriteString(w, encodedPage)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestDecodeTransport(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		status         int
+		encoding       string // Content-Encoding sent back, "raw deflate" is sent as deflate
+		acceptEncoding string // Set by the caller
+		wantAccept     string
+		wantBody       string
+	}{
+		{"gzip", http.MethodGet, http.StatusOK, "gzip", "", acceptEncoding, encodedPage},
+		{"x-gzip", http.MethodGet, http.StatusOK, "x-gzip", "", acceptEncoding, encodedPage},
+		{"zlib deflate", http.MethodGet, http.StatusOK, "deflate", "", acceptEncoding, encodedPage},
+		{"raw deflate", http.MethodGet, http.StatusOK, "raw deflate", "", acceptEncoding, encodedPage},
+		{"brotli", http.MethodGet, http.StatusOK, "br", "", acceptEncoding, encodedPage},
+		{"uncompressed", http.MethodGet, http.StatusOK, "", "", acceptEncoding, encodedPage},
+		{"caller's Accept-Encoding", http.MethodGet, http.StatusOK, "gzip", "gzip", "gzip", encodedPage},
+		{"empty HEAD", http.MethodHead, http.StatusOK, "gzip", "", acceptEncoding, ""},
+		{"empty 204", http.MethodGet, http.StatusNoContent, "br", "", acceptEncoding, ""},
+		{"empty deflate 204", http.MethodGet, http.StatusNoContent, "deflate", "", acceptEncoding, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var accepted string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				accepted = r.Header.Get("Accept-Encoding")
+				if tt.encoding != "" {
+					encoding := tt.encoding
+					if encoding == "raw deflate" {
+						encoding = "deflate"
+					}
+					w.Header().Set("Content-Encoding", encoding)
+				}
+				w.WriteHeader(tt.status)
+				if tt.status != http.StatusNoContent && r.Method != http.MethodHead {
+					w.Write(compress(t, tt.encoding))
+				}
+			}))
+			defer srv.Close()
+
+			s := NewSession(data_handling.Options{}, nil)
+			req, _ := http.NewRequest(tt.method, srv.URL, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			resp, err := s.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("reading body: %v", err)
+			}
+
+			if accepted != tt.wantAccept {
+				t.Errorf("sent Accept-Encoding %q, want %q", accepted, tt.wantAccept)
+			}
+			if string(body) != tt.wantBody {
+				t.Errorf("body %q, want %q", body, tt.wantBody)
+			}
+			if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+				t.Errorf("Content-Encoding %q left on a decoded response", encoding)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Match any error of their type with errors.Is, e.g. errors.Is(err, ErrUnexpectedStatus)
+var (
+	ErrTransport        = errors.New("Request failed")
+	ErrUnexpectedStatus = errors.New("Unexpected status code")
+	ErrParse            = errors.New("Could not parse response")
+)
+
+// How much of an unexpected response is kept for the error message
+const bodySnippetSize = 256
+
+// TransportError is a request that got no response, e.g. a DNS, connection or TLS failure or a timeout
+type TransportError struct {
+	Method string
+	URL    string
+	Err    error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Method, Redact(e.URL), e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TransportError) Is(target error) bool {
+	return target == ErrTransport
+}
+
+// UnexpectedStatusError is a response with a status code the caller can't carry on from
+type UnexpectedStatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string // Start of the body, redacted
+}
+
+// NewUnexpectedStatusError describes resp, given the body or as much of it as has been read
+func NewUnexpectedStatusError(resp *http.Response, body []byte) *UnexpectedStatusError {
+	e := &UnexpectedStatusError{StatusCode: resp.StatusCode, Body: snippet(body)}
+	if resp.Request != nil {
+		e.Method = resp.Request.Method
+		e.URL = resp.Request.URL.String()
+	}
+	return e
+}
+
+func (e *UnexpectedStatusError) Error() string {
+	msg := fmt.Sprintf("%s %s: unexpected status code %d", e.Method, Redact(e.URL), e.StatusCode)
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+func (e *UnexpectedStatusError) Is(target error) bool {
+	return target == ErrUnexpectedStatus
+}
+
+// CheckStatus returns an UnexpectedStatusError unless resp has one of the wanted
+// status codes. The body is only read when the status is unexpected.
+func CheckStatus(resp *http.Response, want ...int) error {
+	for _, code := range want {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, bodySnippetSize))
+	return NewUnexpectedStatusError(resp, body)
+}
+
+// ParseError is a response that didn't contain a field the caller needed
+type ParseError struct {
+	Field string
+	URL   string
+	Err   error // Why the field couldn't be read, nil when it was missing
+}
+
+func (e *ParseError) Error() string {
+	msg := fmt.Sprintf("Could not find %s", e.Field)
+	if e.Err != nil {
+		msg = fmt.Sprintf("Could not read %s", e.Field)
+	}
+	if e.URL != "" {
+		msg += " in " + Redact(e.URL)
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ParseError) Is(target error) bool {
+	return target == ErrParse
+}
+
+// transportError wraps a failed send, dropping the *url.Error since TransportError
+// carries the same details. A TransportError from middleware is returned as is.
+func transportError(req *http.Request, err error) error {
+	var transportErr *TransportError
+	if errors.As(err, &transportErr) {
+		return err
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	return &TransportError{Method: req.Method, URL: req.URL.String(), Err: err}
+}
+
+func snippet(body []byte) string {
+	s := Redact(strings.TrimSpace(string(body)))
+	if len(s) > bodySnippetSize {
+		s = strings.ToValidUTF8(s[:bodySnippetSize], "") + "..."
+	}
+	return s
+}
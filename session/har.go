@@ -0,0 +1,384 @@
+package session
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2 types, see http://www.softwareishard.com/blog/har-12-spec/
+
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"` // Total ms, the sum of the non-negative timings
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Connection      string      `json:"connection,omitempty"`
+	Comment         string      `json:"comment,omitempty"` // Transport error, if the request failed
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"` // "base64" for bodies that aren't text
+}
+
+// HARTimings are in milliseconds, -1 when a phase didn't happen (e.g. a reused connection)
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"` // Includes SSL, as the spec asks
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// HARRecorder is a RoundTripper that records every request and response passing
+// through it. Bodies, headers, cookies and URLs are redacted before they are stored.
+type HARRecorder struct {
+	mu      sync.Mutex
+	base    http.RoundTripper
+	entries []HAREntry
+}
+
+// Constructor
+func NewHARRecorder(base http.RoundTripper) *HARRecorder {
+	return &HARRecorder{base: base}
+}
+
+// Record starts recording the session's requests, including each retry, and returns the recorder
+func (s *Session) Record() *HARRecorder {
+	if s.recorder == nil {
+		s.recorder = NewHARRecorder(s.base)
+		s.rebuild()
+	}
+	return s.recorder
+}
+
+// harTrace collects the timestamps httptrace reports for one request. The
+// transport calls the hooks from its own goroutines (e.g. DNS and dialing run
+// apart from the request), so every field is behind mu.
+type harTrace struct {
+	mu                                                  sync.Mutex
+	start, dnsStart, dnsDone, connectStart, connectDone time.Time
+	tlsStart, tlsDone, gotConn, wroteRequest, firstByte time.Time
+	remoteAddr                                          string
+}
+
+// mark sets *at to now
+func (t *harTrace) mark(at *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	*at = time.Now()
+}
+
+func (t *harTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { t.mark(&t.dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { t.mark(&t.dnsDone) },
+		ConnectStart:      func(string, string) { t.mark(&t.connectStart) },
+		ConnectDone:       func(string, string, error) { t.mark(&t.connectDone) },
+		TLSHandshakeStart: func() { t.mark(&t.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { t.mark(&t.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.gotConn = time.Now()
+			if info.Conn != nil {
+				t.remoteAddr = info.Conn.RemoteAddr().String()
+			}
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.mark(&t.wroteRequest) },
+		GotFirstResponseByte: func() { t.mark(&t.firstByte) },
+	}
+}
+
+func (t *harTrace) serverAddr() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return hostOnly(t.remoteAddr)
+}
+
+func (r *HARRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		reqBody, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	trace := &harTrace{start: time.Now()}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace()))
+
+	entry := HAREntry{
+		StartedDateTime: trace.start,
+		Request:         harRequest(req, reqBody),
+	}
+
+	resp, err := r.base.RoundTrip(req)
+	if err != nil {
+		entry.Comment = Redact(err.Error())
+		entry.Timings = trace.timings(time.Now())
+		entry.Time = entry.Timings.total()
+		r.add(entry)
+		return nil, err
+	}
+
+	// The body is read here so it can be recorded, then handed back unread
+	respBody, readErr := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	entry.Response = harResponse(resp, respBody)
+	entry.Timings = trace.timings(time.Now())
+	entry.Time = entry.Timings.total()
+	entry.ServerIPAddress = trace.serverAddr()
+	if readErr != nil {
+		// What arrived is recorded, but a RoundTripper returns a response or an error, not both
+		entry.Comment = Redact(readErr.Error())
+		r.add(entry)
+		return nil, readErr
+	}
+	r.add(entry)
+
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	return resp, nil
+}
+
+func (r *HARRecorder) add(entry HAREntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, entry)
+}
+
+// Entries returns what has been recorded since the last Save
+func (r *HARRecorder) Entries() []HAREntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]HAREntry(nil), r.entries...)
+}
+
+// Save writes the recorded entries to path as a HAR file and starts a new recording
+func (r *HARRecorder) Save(path string) error {
+	r.mu.Lock()
+	entries := r.entries
+	r.entries = nil
+	r.mu.Unlock()
+
+	if entries == nil {
+		entries = []HAREntry{}
+	}
+	data, err := json.MarshalIndent(HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "Alin-Go", Version: "1.0"},
+		Entries: entries,
+	}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func harRequest(req *http.Request, body []byte) HARRequest {
+	h := HARRequest{
+		Method:      req.Method,
+		URL:         Redact(req.URL.String()),
+		HTTPVersion: req.Proto,
+		Cookies:     []HARNameValue{},
+		Headers:     harHeaders(req.Header),
+		QueryString: []HARNameValue{},
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+	if req.Host != "" && req.Host != req.URL.Host {
+		h.Headers = append(h.Headers, HARNameValue{"Host", req.Host})
+	}
+	for _, cookie := range req.Cookies() {
+		h.Cookies = append(h.Cookies, redactPair(cookie.Name, cookie.Value))
+	}
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			h.QueryString = append(h.QueryString, redactPair(name, value))
+		}
+	}
+	if body != nil {
+		h.PostData = &HARPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Text:     Redact(string(body)),
+		}
+	}
+	return h
+}
+
+func harResponse(resp *http.Response, body []byte) HARResponse {
+	h := HARResponse{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: resp.Proto,
+		Cookies:     []HARNameValue{},
+		Headers:     harHeaders(resp.Header),
+		RedirectURL: Redact(resp.Header.Get("Location")),
+		HeadersSize: -1,
+		BodySize:    len(body),
+		Content: HARContent{
+			Size:     len(body),
+			MimeType: resp.Header.Get("Content-Type"),
+		},
+	}
+	for _, cookie := range resp.Cookies() {
+		h.Cookies = append(h.Cookies, redactPair(cookie.Name, cookie.Value))
+	}
+	// Compressed or binary bodies can't be redacted, so only their size is kept
+	switch {
+	case utf8.Valid(body):
+		h.Content.Text = Redact(string(body))
+	case resp.Header.Get("Content-Encoding") == "":
+		h.Content.Text = base64.StdEncoding.EncodeToString(body)
+		h.Content.Encoding = "base64"
+	}
+	return h
+}
+
+func harHeaders(header http.Header) []HARNameValue {
+	headers := []HARNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			headers = append(headers, redactPair(name, value))
+		}
+	}
+	return headers
+}
+
+// redactPair redacts value in the context of its name, so e.g. an authenticity_token
+// query parameter or an authorization header is caught
+func redactPair(name, value string) HARNameValue {
+	redacted := Redact(name + "=" + value)
+	return HARNameValue{name, strings.TrimPrefix(redacted, name+"=")}
+}
+
+func (t *harTrace) timings(end time.Time) HARTimings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ms := func(from, to time.Time) float64 {
+		if from.IsZero() || to.IsZero() {
+			return -1
+		}
+		return float64(to.Sub(from).Microseconds()) / 1000
+	}
+
+	timings := HARTimings{
+		DNS:     ms(t.dnsStart, t.dnsDone),
+		Connect: ms(t.connectStart, t.connectDone),
+		SSL:     ms(t.tlsStart, t.tlsDone),
+		Send:    ms(t.gotConn, t.wroteRequest),
+		Wait:    ms(t.wroteRequest, t.firstByte),
+		Receive: ms(t.firstByte, end),
+		Blocked: -1,
+	}
+	// Time spent waiting for a connection, other than setting one up
+	if !t.gotConn.IsZero() {
+		blocked := ms(t.start, t.gotConn)
+		for _, phase := range []float64{timings.DNS, timings.Connect, timings.SSL} {
+			if phase > 0 {
+				blocked -= phase
+			}
+		}
+		if blocked >= 0 {
+			timings.Blocked = blocked
+		}
+	}
+	if timings.Connect >= 0 && timings.SSL > 0 {
+		timings.Connect += timings.SSL
+	}
+	for _, phase := range []*float64{&timings.Send, &timings.Wait, &timings.Receive} {
+		if *phase < 0 {
+			*phase = 0
+		}
+	}
+	return timings
+}
+
+func (t HARTimings) total() float64 {
+	total := 0.0
+	for _, phase := range []float64{t.Blocked, t.DNS, t.Connect, t.Send, t.Wait, t.Receive} {
+		if phase > 0 {
+			total += phase
+		}
+	}
+	return total
+}
+
+func hostOnly(addr string) string {
+	if i := strings.LastIndex(addr, ":"); i >= 0 {
+		return strings.Trim(addr[:i], "[]")
+	}
+	return addr
+}
@@ -0,0 +1,177 @@
+package session
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrNoHARMatch = errors.New("No recorded response matches the request")
+
+// Stands in for redacted values in replayed responses. It matches the token
+// regexes in the checkout steps, and Redact turns it back into a placeholder
+// when it is sent in the next request.
+const replayToken = "redacted0000000000000000"
+
+// LoadHAR reads a HAR file
+func LoadHAR(path string) (*HAR, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var har HAR
+	if err := json.Unmarshal(data, &har); err != nil {
+		return nil, fmt.Errorf("Could not read %s: %w", path, err)
+	}
+	return &har, nil
+}
+
+// HARReplayer is a RoundTripper that answers requests from a recorded HAR instead
+// of the network. Requests are redacted the same way recordings are before
+// matching on method, URL and body. Each entry is used once, in order, so repeated
+// requests (e.g. polling /processing) get the responses in the order they were recorded.
+type HARReplayer struct {
+	mu      sync.Mutex
+	entries []HAREntry
+	used    []bool
+	Strict  bool // Require the body to match. Otherwise method and URL are enough when no body matches.
+}
+
+// Constructor
+func NewHARReplayer(har *HAR) *HARReplayer {
+	return &HARReplayer{
+		entries: har.Log.Entries,
+		used:    make([]bool, len(har.Log.Entries)),
+	}
+}
+
+// Replay answers the session's requests from the HAR file at path
+func (s *Session) Replay(path string) (*HARReplayer, error) {
+	har, err := LoadHAR(path)
+	if err != nil {
+		return nil, err
+	}
+	replayer := NewHARReplayer(har)
+	s.SetTransport(replayer)
+	return replayer, nil
+}
+
+func (r *HARReplayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+
+	reqURL := normalizeReplay(req.URL.String())
+	reqBody := normalizeReplay(string(body))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	match := -1
+	for i, entry := range r.entries {
+		if r.used[i] || entry.Request.Method != req.Method || normalizeReplay(entry.Request.URL) != reqURL {
+			continue
+		}
+		if recordedBody(entry) == reqBody {
+			match = i
+			break
+		}
+		if match < 0 && !r.Strict {
+			match = i
+		}
+	}
+	if match < 0 {
+		// The session wraps this in a TransportError, which names the request
+		return nil, ErrNoHARMatch
+	}
+	r.used[match] = true
+
+	return replayResponse(req, r.entries[match])
+}
+
+// Remaining is the number of recorded entries not yet replayed
+func (r *HARReplayer) Remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, used := range r.used {
+		if !used {
+			n++
+		}
+	}
+	return n
+}
+
+func recordedBody(entry HAREntry) string {
+	if entry.Request.PostData == nil {
+		return ""
+	}
+	return normalizeReplay(entry.Request.PostData.Text)
+}
+
+// normalizeReplay redacts s like a recording and undoes what replaying does to
+// placeholders, so requests built from replayed responses match the recording
+func normalizeReplay(s string) string {
+	s = strings.ReplaceAll(s, replayToken, redacted)
+	s = strings.NewReplacer("%5BREDACTED%5D", redacted, "%5bREDACTED%5d", redacted).Replace(s)
+	return Redact(s)
+}
+
+func replayResponse(req *http.Request, entry HAREntry) (*http.Response, error) {
+	if entry.Comment != "" {
+		// The recorded request failed in the transport or while reading the body, so this one does too
+		return nil, errors.New(entry.Comment)
+	}
+
+	var body []byte
+	switch entry.Response.Content.Encoding {
+	case "base64":
+		var err error
+		body, err = base64.StdEncoding.DecodeString(entry.Response.Content.Text)
+		if err != nil {
+			return nil, fmt.Errorf("Could not decode recorded body: %w", err)
+		}
+	default:
+		body = []byte(strings.ReplaceAll(entry.Response.Content.Text, redacted, replayToken))
+	}
+
+	header := http.Header{}
+	for _, h := range entry.Response.Headers {
+		switch http.CanonicalHeaderKey(h.Name) {
+		// The recorded body is stored decoded and may have changed length with the placeholders
+		case "Content-Length", "Content-Encoding":
+			continue
+		}
+		header.Add(h.Name, strings.ReplaceAll(h.Value, redacted, replayToken))
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.Response.Status, entry.Response.StatusText),
+		StatusCode:    entry.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,53 @@
+package session
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"alin/packages/shopify/data_handling"
+)
+
+func TestReplay(t *testing.T) {
+	har := &HAR{Log: HARLog{Entries: []HAREntry{
+		{
+			Request: HARRequest{Method: http.MethodGet, URL: "https://shop.example.com/products/dunk-low"},
+			Response: HARResponse{
+				Status: http.StatusOK, StatusText: "OK",
+				Content: HARContent{Text: `{"id":40000000000002,"token":"[REDACTED]"}`},
+			},
+		},
+	}}}
+	replayer := NewHARReplayer(har)
+	s := NewSession(data_handling.Options{}, nil)
+	s.SetTransport(replayer)
+
+	req, _ := http.NewRequest(http.MethodGet, "https://shop.example.com/products/dunk-low", nil)
+	resp, err := s.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"id":40000000000002,"token":"` + replayToken + `"}`; string(body) != want {
+		t.Errorf("replayed body %s, want %s", body, want)
+	}
+
+	// Each entry answers once
+	req, _ = http.NewRequest(http.MethodGet, "https://shop.example.com/products/dunk-low", nil)
+	_, err = s.Do(req)
+	if !errors.Is(err, ErrNoHARMatch) || !errors.Is(err, ErrTransport) {
+		t.Fatalf("second request = %v, want ErrNoHARMatch", err)
+	}
+	if n := strings.Count(err.Error(), "shop.example.com"); n != 1 {
+		t.Errorf("%q names the request %d times, want once", err, n)
+	}
+	if replayer.Remaining() != 0 {
+		t.Errorf("%d entries left", replayer.Remaining())
+	}
+}
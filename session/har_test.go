@@ -0,0 +1,74 @@
+package session
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHARRecorder(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/short" {
+			// Promise more than is sent, so reading the body fails
+			w.Header().Set("Content-Length", "100")
+			io.WriteString(w, "partial")
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"got":"`+string(body)+`","email":"test@example.com"}`)
+	}))
+	defer srv.Close()
+
+	recorder := NewHARRecorder(srv.Client().Transport)
+	client := &http.Client{Transport: recorder}
+
+	// Concurrent requests dial concurrently, which is what the trace hooks must cope with
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Post(srv.URL+"/cart/add.js", "application/x-www-form-urlencoded", strings.NewReader("id=40000000000002"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if !strings.Contains(string(body), "test@example.com") {
+				t.Errorf("body handed back changed: %s", body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	entries := recorder.Entries()
+	if len(entries) != 8 {
+		t.Fatalf("recorded %d entries, want 8", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Response.Status != http.StatusOK || entry.ServerIPAddress == "" || entry.Time <= 0 {
+			t.Errorf("entry missing response or timings: %+v", entry)
+		}
+		if entry.Request.PostData == nil || entry.Request.PostData.Text != "id=40000000000002" {
+			t.Errorf("request body recorded as %+v", entry.Request.PostData)
+		}
+		if strings.Contains(entry.Response.Content.Text, "test@example.com") {
+			t.Errorf("response recorded without redaction: %s", entry.Response.Content.Text)
+		}
+	}
+
+	resp, err := client.Get(srv.URL + "/short")
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("truncated body didn't fail the request")
+	}
+	entries = recorder.Entries()
+	if last := entries[len(entries)-1]; last.Comment == "" || last.Response.Content.Text != "partial" {
+		t.Errorf("truncated response recorded as %+v", last)
+	}
+}
@@ -0,0 +1,100 @@
+package session
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HeaderPreset is the set of headers a browser sends for one kind of request
+type HeaderPreset int
+
+const (
+	// PresetNavigate is a top level page load, e.g. following a link or redirect
+	PresetNavigate HeaderPreset = iota
+	// PresetFormPost is a page submitting a form, which navigates to the response
+	PresetFormPost
+	// PresetXHRJSON is a script on the page calling a JSON endpoint with fetch or XHR
+	PresetXHRJSON
+)
+
+var headerPresetNames = map[HeaderPreset]string{
+	PresetNavigate: "navigate",
+	PresetFormPost: "form post",
+	PresetXHRJSON:  "xhr json",
+}
+
+func (p HeaderPreset) String() string {
+	return headerPresetNames[p]
+}
+
+// Page is where a request is made from
+type Page struct {
+	Domain  string // The site's host, used for Origin and to tell same-origin from cross-site requests
+	Referer string // URL of the page, "" for a request typed into the address bar
+}
+
+func (p Page) origin() string {
+	return "https://" + p.Domain
+}
+
+// fetchSite is Sec-Fetch-Site for a request from the page to target
+func (p Page) fetchSite(target *url.URL) string {
+	switch {
+	case p.Referer == "":
+		return "none"
+	case strings.EqualFold(target.Host, p.Domain):
+		return "same-origin"
+	case strings.HasSuffix(strings.ToLower(target.Hostname()), "."+strings.ToLower(p.Domain)):
+		return "same-site"
+	default:
+		return "cross-site"
+	}
+}
+
+// NewRequest builds a request with the preset's headers for a request from page.
+// Set any extra or different headers on the result.
+func (s *Session) NewRequest(ctx context.Context, method, target string, body io.Reader, preset HeaderPreset, page Page) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+
+	h := req.Header
+	h.Set("User-Agent", s.Useragent)
+	h.Set("Accept-Language", "en-GB,en;q=0.5")
+	h.Set("Connection", "keep-alive")
+	if page.Referer != "" {
+		h.Set("Referer", page.Referer)
+	}
+	// Browsers only send Origin with requests that can change something
+	if method != http.MethodGet && method != http.MethodHead {
+		h.Set("Origin", page.origin())
+	}
+	h.Set("Sec-Fetch-Site", page.fetchSite(req.URL))
+
+	switch preset {
+	case PresetNavigate, PresetFormPost:
+		h.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8")
+		h.Set("Upgrade-Insecure-Requests", "1")
+		h.Set("Sec-Fetch-Dest", "document")
+		h.Set("Sec-Fetch-Mode", "navigate")
+		h.Set("Sec-Fetch-User", "?1")
+		if preset == PresetFormPost {
+			h.Set("Content-Type", "application/x-www-form-urlencoded")
+			h.Set("Cache-Control", "max-age=0")
+		}
+	case PresetXHRJSON:
+		h.Set("Accept", "application/json, text/plain, */*")
+		h.Set("Sec-Fetch-Dest", "empty")
+		h.Set("Sec-Fetch-Mode", "cors")
+		h.Set("Pragma", "no-cache")
+		h.Set("Cache-Control", "no-cache")
+		if body != nil {
+			h.Set("Content-Type", "application/json;charset=utf-8")
+		}
+	}
+	return req, nil
+}
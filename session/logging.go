@@ -0,0 +1,161 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type LogFormat string
+
+const (
+	LogConsole LogFormat = "console"
+	LogJSON    LogFormat = "json"
+)
+
+// LogConfig controls what the loggers write and where
+type LogConfig struct {
+	Level      string    `json:"level"`      // debug, info, warn or error
+	Format     LogFormat `json:"format"`     // Format of stdout/stderr output. Task files are always JSON.
+	TaskFiles  bool      `json:"taskFiles"`  // Also write each task's lines to <Dir>/task-<id>.log
+	HARFiles   bool      `json:"harFiles"`   // Record each task attempt's requests to <Dir>/task-<id>-<time>-<attempt>.har
+	Dir        string    `json:"dir"`        // Directory for task and HAR files
+	MaxSizeMB  int       `json:"maxSizeMb"`  // Size a task file can reach before it is rotated
+	MaxBackups int       `json:"maxBackups"` // Rotated files kept per task
+}
+
+// DefaultLogConfig logs Info and above as JSON to stdout/stderr, without task files
+func DefaultLogConfig() LogConfig {
+	return LogConfig{
+		Level:      "info",
+		Format:     LogJSON,
+		MaxSizeMB:  10,
+		MaxBackups: 3,
+	}
+}
+
+// LoadLogConfig reads a config file over the defaults. A missing file gives the defaults.
+func LoadLogConfig(path string) (LogConfig, error) {
+	config := DefaultLogConfig()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return DefaultLogConfig(), fmt.Errorf("Could not read %s: %w", path, err)
+	}
+	return config, config.validate()
+}
+
+// SaveLogConfig writes the config so LoadLogConfig picks it up on the next launch
+func SaveLogConfig(path string, config LogConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func (c LogConfig) validate() error {
+	if _, err := c.level(); err != nil {
+		return err
+	}
+	switch c.Format {
+	case "", LogConsole, LogJSON:
+	default:
+		return fmt.Errorf("Unknown log format %q", c.Format)
+	}
+	if (c.TaskFiles || c.HARFiles) && c.Dir == "" {
+		return errors.New("A log directory is required for task and HAR files")
+	}
+	return nil
+}
+
+func (c LogConfig) level() (zapcore.Level, error) {
+	if c.Level == "" {
+		return zapcore.InfoLevel, nil
+	}
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return level, fmt.Errorf("Unknown log level %q", c.Level)
+	}
+	return level, nil
+}
+
+func (c LogConfig) encoder() zapcore.Encoder {
+	if c.Format == LogConsole {
+		return NewRedactingEncoder(zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig()))
+	}
+	return NewRedactingEncoder(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()))
+}
+
+// NewLogger logs with the default config
+func NewLogger() *zap.Logger {
+	logger, _ := NewLoggerWithConfig(DefaultLogConfig())
+	return logger
+}
+
+// NewLoggerWithConfig sends lines below Error to stdout and Error and above to
+// stderr. Every line is redacted.
+func NewLoggerWithConfig(config LogConfig) (*zap.Logger, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	minLevel, _ := config.level()
+
+	// Enabled levels below error
+	outLevel := zap.LevelEnablerFunc(func(level zapcore.Level) bool {
+		return level >= minLevel && level < zapcore.ErrorLevel
+	})
+
+	// Error and above, whatever the configured level
+	errLevel := zap.LevelEnablerFunc(func(level zapcore.Level) bool {
+		return level >= minLevel && level >= zapcore.ErrorLevel
+	})
+
+	core := zapcore.NewTee(
+		zapcore.NewCore(config.encoder(), zapcore.Lock(os.Stdout), outLevel),
+		zapcore.NewCore(config.encoder(), zapcore.Lock(os.Stderr), errLevel),
+	)
+	return zap.New(core), nil
+}
+
+// TaskLogger tags base with the task ID and, when task files are enabled, also
+// writes to the task's own rotating file. close must be called once the task has finished.
+func (c LogConfig) TaskLogger(base *zap.Logger, taskID int) (logger *zap.Logger, close func() error, err error) {
+	logger = base.With(zap.Int("Task", taskID))
+	if !c.TaskFiles {
+		return logger, func() error { return nil }, nil
+	}
+
+	minLevel, err := c.level()
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := NewRotatingFile(filepath.Join(c.Dir, fmt.Sprintf("task-%d.log", taskID)), int64(c.MaxSizeMB)*1024*1024, c.MaxBackups)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fileCore := zapcore.NewCore(
+		NewRedactingEncoder(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())),
+		file,
+		minLevel,
+	).With([]zapcore.Field{zap.Int("Task", taskID)})
+
+	logger = logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(core, fileCore)
+	}))
+	return logger, file.Close, nil
+}
@@ -0,0 +1,104 @@
+package session
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// TrustCertificates adds the PEM encoded CA certificates in files to the roots the
+// session trusts, on top of the system's, e.g. for a local stand-in with a self-signed certificate
+func (s *Session) TrustCertificates(files ...string) error {
+	if len(files) == 0 {
+		return nil
+	}
+	if s.transport.TLSClientConfig == nil {
+		s.transport.TLSClientConfig = &tls.Config{}
+	}
+	pool := s.transport.TLSClientConfig.RootCAs
+	if pool == nil {
+		var err error
+		if pool, err = x509.SystemCertPool(); err != nil {
+			pool = x509.NewCertPool()
+		}
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("No certificates found in %s", file)
+		}
+	}
+	s.transport.TLSClientConfig.RootCAs = pool
+	return nil
+}
+
+// OverrideHost sends requests for host to base (e.g. "https://localhost:8443")
+// instead. The Host header, cookies and recorded URLs stay those of host, so a
+// stand-in at base sees the requests as the store would.
+func (s *Session) OverrideHost(host, base string) error {
+	target, err := url.Parse(base)
+	if err != nil {
+		return err
+	}
+	if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("Base URL %q must be an absolute http or https URL", base)
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if s.overrides == nil {
+		s.overrides = map[string]*url.URL{}
+	}
+	s.overrides[strings.ToLower(host)] = target
+	s.rebuild()
+	return nil
+}
+
+// overrideTransport rewrites requests for overridden hosts to their base URL
+type overrideTransport struct {
+	next  http.RoundTripper
+	hosts map[string]*url.URL
+}
+
+func (t *overrideTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, ok := t.hosts[strings.ToLower(req.URL.Hostname())]
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+
+	original := req.URL
+	sent := req
+	req = req.Clone(req.Context())
+	if req.Host == "" {
+		req.Host = original.Host
+	}
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	if prefix := strings.TrimSuffix(target.Path, "/"); prefix != "" {
+		req.URL.Path = prefix + req.URL.Path
+		req.URL.RawPath = ""
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	// Redirects the stand-in builds from its own address lead back to the store
+	if location, err := resp.Location(); err == nil && strings.EqualFold(location.Host, target.Host) {
+		location.Scheme = original.Scheme
+		location.Host = original.Host
+		location.Path = strings.TrimPrefix(location.Path, strings.TrimSuffix(target.Path, "/"))
+		resp.Header.Set("Location", location.String())
+	}
+	// Redirect chains show the store's URLs
+	resp.Request = sent
+	return resp, nil
+}
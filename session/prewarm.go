@@ -0,0 +1,106 @@
+package session
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Warmup is what opening a connection to one host cost
+type Warmup struct {
+	Host      string
+	DNS       time.Duration // Resolving the host, 0 when it was an IP or went through a proxy
+	Connect   time.Duration // TCP connect
+	Handshake time.Duration // TLS handshake
+	Total     time.Duration // The whole request, from sending it to the response headers
+	Reused    bool          // A connection was already open, so nothing was set up
+	Err       error
+}
+
+// Prewarm resolves hosts and opens a keep-alive connection to each, in parallel,
+// so the first requests sent to them don't pay for DNS, TCP and TLS. The
+// connections stay open as long as the server keeps idle connections, so prewarm
+// shortly before they're needed. Each host gets a HEAD / through host limits and
+// overrides, but not middleware, retries or recording. Nothing is sent when
+// SetDoer replaced the client, since there are no connections of ours to open.
+func (s *Session) Prewarm(ctx context.Context, hosts ...string) []Warmup {
+	if s.doer != nil {
+		return nil
+	}
+	var rt http.RoundTripper = s.base
+	if len(s.overrides) > 0 {
+		rt = &overrideTransport{next: rt, hosts: s.overrides}
+	}
+	rt = &rateLimitTransport{next: rt, waited: &s.limitWait}
+
+	warmups := make([]Warmup, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			warmups[i] = s.warm(ctx, rt, host)
+		}(i, host)
+	}
+	wg.Wait()
+	return warmups
+}
+
+func (s *Session) warm(ctx context.Context, rt http.RoundTripper, host string) Warmup {
+	// The trace runs on the transport's dialing goroutine, which can outlive RoundTrip when ctx is cancelled
+	var (
+		mu                                     sync.Mutex
+		w                                      = Warmup{Host: host}
+		dnsStart, connectStart, handshakeStart time.Time
+	)
+	since := func(start time.Time, d *time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		*d = time.Since(start)
+	}
+	started := func(t *time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		*t = time.Now()
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { started(&dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { since(dnsStart, &w.DNS) },
+		ConnectStart:      func(string, string) { started(&connectStart) },
+		ConnectDone:       func(string, string, error) { since(connectStart, &w.Connect) },
+		TLSHandshakeStart: func() { started(&handshakeStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { since(handshakeStart, &w.Handshake) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			w.Reused = info.Reused
+		},
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodHead, "https://"+strings.TrimSuffix(host, "/")+"/", nil)
+	if err != nil {
+		return Warmup{Host: host, Err: err}
+	}
+	req.Header.Set("User-Agent", s.Useragent)
+
+	start := time.Now()
+	resp, err := rt.RoundTrip(req)
+	total := time.Since(start)
+	if err == nil {
+		// Any status will do, the connection is what's wanted. Closing the body puts it back in the pool.
+		resp.Body.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	result := w
+	result.Total = total
+	if err != nil {
+		result.Err = transportError(req, err)
+	}
+	return result
+}
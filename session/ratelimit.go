@@ -0,0 +1,119 @@
+package session
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HostLimit is a request budget for one host, shared by every Session in the process
+type HostLimit struct {
+	Rate  float64 // Requests per second, 0 for no limit
+	Burst int     // Requests that can be sent at once after a quiet spell, at least 1
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate per second. Each request takes one.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit HostLimit) *tokenBucket {
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: limit.Rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes a token and returns how long to wait before it may be used
+func (b *tokenBucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel returns a reserved token that was never used
+func (b *tokenBucket) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens++
+}
+
+var (
+	limitersMu sync.RWMutex
+	limiters   = map[string]*tokenBucket{}
+)
+
+// SetHostLimit sets the request budget for host across all sessions. A zero Rate removes the limit.
+func SetHostLimit(host string, limit HostLimit) {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	host = strings.ToLower(host)
+	if limit.Rate <= 0 {
+		delete(limiters, host)
+		return
+	}
+	limiters[host] = newTokenBucket(limit)
+}
+
+func hostLimiter(host string) *tokenBucket {
+	limitersMu.RLock()
+	defer limitersMu.RUnlock()
+	return limiters[strings.ToLower(host)]
+}
+
+// rateLimitTransport holds requests back until their host's bucket has a token
+type rateLimitTransport struct {
+	next   http.RoundTripper
+	waited *int64 // Nanoseconds, shared with the session
+	onWait func(host string, wait time.Duration)
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	bucket := hostLimiter(host)
+	if bucket == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	wait := bucket.reserve()
+	if wait > 0 {
+		if t.onWait != nil {
+			t.onWait(host, wait)
+		}
+		start := time.Now()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			bucket.cancel()
+			atomic.AddInt64(t.waited, int64(time.Since(start)))
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, req.Context().Err()
+		}
+		atomic.AddInt64(t.waited, int64(time.Since(start)))
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,135 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(HostLimit{Rate: 10, Burst: 3})
+
+	// A full bucket lets the burst through at once
+	for i := 0; i < 3; i++ {
+		if wait := b.reserve(); wait != 0 {
+			t.Fatalf("request %d of the burst waits %s", i+1, wait)
+		}
+	}
+	// Then one token every 100ms
+	if wait := b.reserve(); wait < 90*time.Millisecond || wait > 100*time.Millisecond {
+		t.Errorf("first request past the burst waits %s, want about 100ms", wait)
+	}
+	if wait := b.reserve(); wait < 190*time.Millisecond || wait > 200*time.Millisecond {
+		t.Errorf("second request past the burst waits %s, want about 200ms", wait)
+	}
+
+	// A cancelled request gives its token back to the ones behind it
+	b.cancel()
+	if wait := b.reserve(); wait < 190*time.Millisecond || wait > 200*time.Millisecond {
+		t.Errorf("request after a cancel waits %s, want about 200ms", wait)
+	}
+
+	// A quiet spell refills the bucket, but never past the burst
+	b.mu.Lock()
+	b.last = b.last.Add(-time.Hour)
+	b.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		if wait := b.reserve(); wait != 0 {
+			t.Fatalf("request %d after a quiet spell waits %s", i+1, wait)
+		}
+	}
+	if wait := b.reserve(); wait == 0 {
+		t.Error("bucket refilled past its burst")
+	}
+}
+
+func TestTokenBucketMinimumBurst(t *testing.T) {
+	b := newTokenBucket(HostLimit{Rate: 1})
+	if wait := b.reserve(); wait != 0 {
+		t.Errorf("first request waits %s", wait)
+	}
+	if wait := b.reserve(); wait < 900*time.Millisecond {
+		t.Errorf("second request waits %s, want about 1s with a burst of 1", wait)
+	}
+}
+
+func TestSetHostLimit(t *testing.T) {
+	SetHostLimit("Limit.Example.com", HostLimit{Rate: 5, Burst: 2})
+	defer SetHostLimit("limit.example.com", HostLimit{})
+
+	if hostLimiter("limit.example.com") == nil || hostLimiter("LIMIT.example.com") == nil {
+		t.Fatal("limit not found, host names should match whatever their case")
+	}
+	if hostLimiter("other.example.com") != nil {
+		t.Error("limit applies to another host")
+	}
+	SetHostLimit("limit.example.com", HostLimit{Rate: 0, Burst: 2})
+	if hostLimiter("limit.example.com") != nil {
+		t.Error("a zero rate didn't remove the limit")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	const host = "transport.limit.example.com"
+	SetHostLimit(host, HostLimit{Rate: 2, Burst: 1})
+	defer SetHostLimit(host, HostLimit{})
+
+	sent := 0
+	var waited int64
+	var waits []time.Duration
+	transport := &rateLimitTransport{
+		next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			sent++
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+		}),
+		waited: &waited,
+		onWait: func(h string, wait time.Duration) {
+			if h != host {
+				t.Errorf("waited on %q", h)
+			}
+			waits = append(waits, wait)
+		},
+	}
+
+	if _, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "https://"+host+"/", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stopped while waiting for a token, the request isn't sent and the token goes back
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "https://"+host+"/", nil).WithContext(ctx))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("cancelled wait = %v, want DeadlineExceeded", err)
+	}
+	if sent != 1 || len(waits) != 1 || waited < int64(50*time.Millisecond) {
+		t.Errorf("sent %d, waits %v, waited %s", sent, waits, time.Duration(waited))
+	}
+
+	start := time.Now()
+	if _, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "https://"+host+"/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	// Only the first request's token is spent, so this waits out the rest of its 500ms
+	if elapsed := time.Since(start); elapsed > 700*time.Millisecond || elapsed < 350*time.Millisecond {
+		t.Errorf("next request waited %s, want about 450ms", elapsed)
+	}
+	if sent != 2 {
+		t.Errorf("sent %d requests, want 2", sent)
+	}
+
+	// Other hosts aren't held back
+	start = time.Now()
+	if _, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "https://other.example.com/", nil)); err != nil || time.Since(start) > 50*time.Millisecond {
+		t.Errorf("unlimited host: %v after %s", err, time.Since(start))
+	}
+}
@@ -0,0 +1,154 @@
+package session
+
+import (
+	"alin/packages/shopify/data_handling"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+)
+
+const redacted = "[REDACTED]"
+
+var (
+	// A sensitive key followed by its value, as a JSON field (possibly escaped inside
+	// another string), a form field (possibly with URL encoded brackets) or a header
+	sensitiveKeyRegex = regexp.MustCompile(`(?i)([\w-]*(?:token|authorization|verification_value|cvv|cvc|email|phone)(?:%5D|\])?\\?"?\s*[:=]\s*\\?"?(?:Bearer |Basic )?)([^\s"\\&,;}]+)`)
+	// Phone numbers are written with spaces, which end the values above
+	phoneFieldRegex = regexp.MustCompile(`(?i)([\w-]*phone(?:%5D|\])?\\?"?\s*[:=]\s*\\?"?)((?:\+|%2B)?\d[\d() +-]*\d)`)
+	// Hidden form inputs in checkout pages, e.g. <input name="authenticity_token" value="...">
+	sensitiveInputRegex = regexp.MustCompile(`(?i)(name=\\?"[^"\\]*(?:token|verification_value|cvv|cvc)[^"\\]*\\?"\s+value=\\?")([^"\\]+)`)
+	// Payment session ID sent with the payment form
+	sessionParamRegex = regexp.MustCompile(`([?&]s=)([^&\s"\\]+)`)
+	// Checkout tokens in checkout, processing and thank you URLs
+	checkoutURLRegex = regexp.MustCompile(`(/checkouts/(?:c/|cn/)?)([A-Za-z0-9_-]{16,})`)
+	hexTokenRegex    = regexp.MustCompile(`\b[0-9a-f]{32,}\b`)
+	emailRegex       = regexp.MustCompile(`([A-Za-z0-9._+-])[A-Za-z0-9._+-]*(@|%40)([A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,})`)
+	// Card numbers are only looked for where a card is expected, so IDs that happen
+	// to pass the Luhn check (e.g. {"id":40000000000002}) are left alone: after a
+	// number, card number or credit card key, or grouped the way cards are printed
+	cardFieldRegex  = regexp.MustCompile(`(?i)((?:[\w-]*number|[\w-]*card[\w-]*|card(?:\[|%5B)number)(?:%5D|\])?\\?"?\s*[:=]\s*\\?"?)(\d(?:[ +-]?\d){12,18})\b`)
+	groupedPANRegex = regexp.MustCompile(`\b(?:\d{4}[ +-]\d{4}[ +-]\d{4}[ +-]\d{4}|\d{4}[ +-]\d{6}[ +-]\d{5})\b`)
+	phoneRegex      = regexp.MustCompile(`(?:\+|%2B)\d{1,3}[ -]?\d(?:[ -]?\d){6,13}\b|\b0\d(?:[ -]?\d){8,9}\b`)
+)
+
+// Redact masks card numbers (keeping the last four digits), CVVs, emails, phone
+// numbers and checkout and authorization tokens in s
+func Redact(s string) string {
+	s = phoneFieldRegex.ReplaceAllStringFunc(s, func(match string) string {
+		parts := phoneFieldRegex.FindStringSubmatch(match)
+		return parts[1] + maskDigits(parts[2])
+	})
+	s = sensitiveKeyRegex.ReplaceAllStringFunc(s, func(match string) string {
+		parts := sensitiveKeyRegex.FindStringSubmatch(match)
+		key, value := strings.ToLower(parts[1]), parts[2]
+		switch {
+		case value == redacted || strings.Contains(value, "*"):
+			return match
+		case strings.Contains(value, "@") || strings.Contains(value, "%40"):
+			return parts[1] + maskEmail(value)
+		case strings.Contains(key, "phone"):
+			return parts[1] + maskDigits(value)
+		}
+		return parts[1] + redacted
+	})
+	s = sensitiveInputRegex.ReplaceAllString(s, "${1}"+redacted)
+	s = sessionParamRegex.ReplaceAllString(s, "${1}"+redacted)
+	s = checkoutURLRegex.ReplaceAllString(s, "${1}"+redacted)
+	s = hexTokenRegex.ReplaceAllString(s, redacted)
+	s = emailRegex.ReplaceAllString(s, "${1}***${2}${3}")
+	s = cardFieldRegex.ReplaceAllStringFunc(s, func(match string) string {
+		parts := cardFieldRegex.FindStringSubmatch(match)
+		return parts[1] + maskPAN(parts[2])
+	})
+	s = groupedPANRegex.ReplaceAllStringFunc(s, maskPAN)
+	s = phoneRegex.ReplaceAllStringFunc(s, maskDigits)
+	return s
+}
+
+// maskPAN masks s if it is a card number, keeping the last four digits
+func maskPAN(s string) string {
+	digits := strings.NewReplacer(" ", "", "+", "", "-", "").Replace(s)
+	if !luhnValid(digits) {
+		return s
+	}
+	return data_handling.MaskCardNumber(digits)
+}
+
+func maskEmail(email string) string {
+	if masked := emailRegex.ReplaceAllString(email, "${1}***${2}${3}"); masked != email {
+		return masked
+	}
+	return redacted
+}
+
+// maskDigits hides every digit but the last two
+func maskDigits(s string) string {
+	// URL encoded "+" of an international number
+	if strings.HasPrefix(s, "%2B") {
+		return "%2B" + maskDigits(s[3:])
+	}
+	digits := 0
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			digits++
+		}
+	}
+	var b strings.Builder
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			digits--
+			if digits >= 2 {
+				c = '*'
+			}
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func luhnValid(digits string) bool {
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+var redactBufferPool = buffer.NewPool()
+
+// redactingEncoder runs every encoded line, including fields added with Logger.With, through Redact
+type redactingEncoder struct {
+	zapcore.Encoder
+}
+
+// NewRedactingEncoder wraps enc so nothing it writes can contain card data, tokens or PII
+func NewRedactingEncoder(enc zapcore.Encoder) zapcore.Encoder {
+	return redactingEncoder{enc}
+}
+
+func (e redactingEncoder) Clone() zapcore.Encoder {
+	return redactingEncoder{e.Encoder.Clone()}
+}
+
+func (e redactingEncoder) EncodeEntry(entry zapcore.Entry, fields []zapcore.Field) (*buffer.Buffer, error) {
+	buf, err := e.Encoder.EncodeEntry(entry, fields)
+	if err != nil {
+		return nil, err
+	}
+	defer buf.Free()
+
+	out := redactBufferPool.Get()
+	out.AppendString(Redact(buf.String()))
+	return out, nil
+}
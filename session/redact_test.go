@@ -0,0 +1,94 @@
+package session
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "card in deposit JSON",
+			in:   `{"credit_card":{"number":"4242 4242 4242 4242","name":"TEST BUYER","month":"12","year":"2099","verification_value":"123"}}`,
+			want: `{"credit_card":{"number":"**** **** **** 4242","name":"TEST BUYER","month":"12","year":"2099","verification_value":"[REDACTED]"}}`,
+		},
+		{
+			name: "card as a form field",
+			in:   "card[number]=4111111111111111&card%5Bnumber%5D=5555+5555+5555+4444&card[cvv]=123",
+			want: "card[number]=**** **** **** 1111&card%5Bnumber%5D=**** **** **** 4444&card[cvv]=[REDACTED]",
+		},
+		{
+			name: "card key with unbroken digits",
+			in:   `{"card_number":4242424242424242}`,
+			want: `{"card_number":**** **** **** 4242}`,
+		},
+		{
+			name: "grouped card in a message",
+			in:   "declined 4242-4242-4242-4242 and amex 3782 822463 10005",
+			want: "declined **** **** **** 4242 and amex **** **** **** 0005",
+		},
+		{
+			name: "card key failing Luhn",
+			in:   `{"number":"4242424242424241"}`,
+			want: `{"number":"4242424242424241"}`,
+		},
+		{
+			name: "CVV",
+			in:   `cvv=123 "cvc": "1234" checkout[credit_card][verification_value]=987`,
+			want: `cvv=[REDACTED] "cvc": "[REDACTED]" checkout[credit_card][verification_value]=[REDACTED]`,
+		},
+		{
+			name: "email",
+			in:   `{"email":"test.buyer@example.com"} sent to other@example.co.uk checkout[email]=test%40example.com`,
+			want: `{"email":"t***@example.com"} sent to o***@example.co.uk checkout[email]=t***%40example.com`,
+		},
+		{
+			name: "phone",
+			in:   `{"phone":"07700 900123"} call +44 7700 900123 or 07700900123`,
+			want: `{"phone":"***** ****23"} call +** **** ****23 or *********23`,
+		},
+		{
+			name: "tokens",
+			in:   `Authorization: Bearer abc.def authenticity_token=xyz /checkouts/c/0123456789abcdefABCDEF?s=east-123`,
+			want: `Authorization: Bearer [REDACTED] authenticity_token=[REDACTED] /checkouts/c/[REDACTED]?s=[REDACTED]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Redact(tt.in); got != tt.want {
+				t.Errorf("Redact(%s)\n got %s\nwant %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+// IDs that pass the Luhn check aren't card numbers, masking them breaks replay
+func TestRedactKeepsIDs(t *testing.T) {
+	for _, s := range []string{
+		`{"id":"40000000000002"}`,
+		`{"id":40000000000002,"variant_id":40000000000002,"product_id":4111111111111111}`,
+		`{"productVariants":[{"id":"gid://shopify/ProductVariant/40000000000002"}]}`,
+		"/products/dunk-low?variant=40000000000002",
+		"/cart/40000000000002:1",
+		"checkout[shipping_rate][id]=shopify-Standard-4242424242424242",
+	} {
+		if got := Redact(s); got != s {
+			t.Errorf("Redact(%s) = %s, want it unchanged", s, got)
+		}
+	}
+}
+
+func TestRedactIsIdempotent(t *testing.T) {
+	in := `{"number":"4242 4242 4242 4242","email":"test@example.com","phone":"+447700900123","token":"abc"}`
+	once := Redact(in)
+	if twice := Redact(once); twice != once {
+		t.Errorf("Redact changed its own output:\n%s\n%s", once, twice)
+	}
+	if strings.Contains(once, "4242 4242 4242 4242") || strings.Contains(once, "test@") {
+		t.Errorf("Redact left data in %s", once)
+	}
+}
@@ -0,0 +1,88 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+var ErrTooManyRedirects = errors.New("Too many redirects")
+
+// RedirectPolicy decides how far one request follows redirects. The zero value
+// stops at the first redirect and returns it, which is what requests get by default.
+type RedirectPolicy struct {
+	MaxHops int            // Redirects to follow, going over is ErrTooManyRedirects
+	Stop    *regexp.Regexp // Return the redirect instead of following it to a URL matching this
+}
+
+// StopAtFirst returns the first redirect without following it
+func StopAtFirst() RedirectPolicy {
+	return RedirectPolicy{}
+}
+
+// Follow follows up to maxHops redirects
+func Follow(maxHops int) RedirectPolicy {
+	return RedirectPolicy{MaxHops: maxHops}
+}
+
+// FollowUntil follows up to maxHops redirects, stopping at the redirect to a URL
+// matching pattern, e.g. `/processing|/thank_you`
+func FollowUntil(pattern string, maxHops int) RedirectPolicy {
+	return RedirectPolicy{MaxHops: maxHops, Stop: regexp.MustCompile(pattern)}
+}
+
+type redirectKey struct{}
+
+// WithRedirects returns req with policy applied when the session sends it
+func WithRedirects(req *http.Request, policy RedirectPolicy) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), redirectKey{}, policy))
+}
+
+// checkRedirect is the client's CheckRedirect, applying the policy req was sent with
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	policy, _ := req.Context().Value(redirectKey{}).(RedirectPolicy)
+	if policy.Stop != nil && policy.Stop.MatchString(req.URL.String()) {
+		return http.ErrUseLastResponse
+	}
+	if len(via) > policy.MaxHops {
+		if policy.MaxHops == 0 {
+			return http.ErrUseLastResponse
+		}
+		return fmt.Errorf("%w, stopped after %d", ErrTooManyRedirects, policy.MaxHops)
+	}
+	return nil
+}
+
+// Hop is one request in a redirect chain and the status it got
+type Hop struct {
+	Method     string
+	URL        string
+	StatusCode int
+}
+
+func (h Hop) String() string {
+	return fmt.Sprintf("%d %s %s", h.StatusCode, h.Method, Redact(h.URL))
+}
+
+// RedirectChain lists every request made to get resp, the first one first.
+// resp's own request is last.
+func RedirectChain(resp *http.Response) []Hop {
+	var chain []Hop
+	for r := resp; r != nil && r.Request != nil; r = r.Request.Response {
+		chain = append([]Hop{{Method: r.Request.Method, URL: r.Request.URL.String(), StatusCode: r.StatusCode}}, chain...)
+	}
+	return chain
+}
+
+// Landed is where resp leaves the browser: the Location of a redirect that wasn't
+// followed, otherwise the URL of the page that was loaded
+func Landed(resp *http.Response) string {
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		if location, err := resp.Location(); err == nil {
+			return location.String()
+		}
+	}
+	return resp.Request.URL.String()
+}
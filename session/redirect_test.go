@@ -0,0 +1,94 @@
+package session
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"alin/packages/shopify/data_handling"
+)
+
+// newRedirectServer sends /start through two more checkout pages to processing, then thank_you
+func newRedirectServer(t *testing.T) *httptest.Server {
+	next := map[string]string{
+		"/start":                      "/checkouts/c/abc",
+		"/checkouts/c/abc":            "/checkouts/c/abc/payment",
+		"/checkouts/c/abc/payment":    "/checkouts/c/abc/processing",
+		"/checkouts/c/abc/processing": "/checkouts/c/abc/thank_you",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if to, ok := next[r.URL.Path]; ok {
+			http.Redirect(w, r, to, http.StatusFound)
+			return
+		}
+		w.Write([]byte("Thank you"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRedirectPolicies(t *testing.T) {
+	srv := newRedirectServer(t)
+	tests := []struct {
+		name   string
+		policy *RedirectPolicy // Nil to send the request without one
+		status int
+		landed string
+		hops   int
+	}{
+		{"default", nil, http.StatusFound, "/checkouts/c/abc", 1},
+		{"StopAtFirst", ptr(StopAtFirst()), http.StatusFound, "/checkouts/c/abc", 1},
+		{"Follow", ptr(Follow(4)), http.StatusOK, "/checkouts/c/abc/thank_you", 5},
+		{"FollowUntil processing", ptr(FollowUntil(`/processing|/thank_you`, 4)), http.StatusFound, "/checkouts/c/abc/processing", 3},
+		{"FollowUntil without a match", ptr(FollowUntil(`/stock_problems`, 4)), http.StatusOK, "/checkouts/c/abc/thank_you", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSession(data_handling.Options{}, nil)
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+"/start", nil)
+			if tt.policy != nil {
+				req = WithRedirects(req, *tt.policy)
+			}
+			resp, err := s.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if landed := Landed(resp); landed != srv.URL+tt.landed {
+				t.Errorf("landed on %s, want %s", landed, tt.landed)
+			}
+			chain := RedirectChain(resp)
+			if len(chain) != tt.hops {
+				t.Fatalf("chain %v, want %d requests", chain, tt.hops)
+			}
+			if first := chain[0]; first.URL != srv.URL+"/start" || first.StatusCode != http.StatusFound || first.Method != http.MethodGet {
+				t.Errorf("chain starts with %s, want the 302 from /start", first)
+			}
+		})
+	}
+}
+
+func TestTooManyRedirects(t *testing.T) {
+	srv := newRedirectServer(t)
+	s := NewSession(data_handling.Options{}, nil)
+
+	// Four redirects to reach thank_you, three allowed
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/start", nil)
+	_, err := s.Do(WithRedirects(req, Follow(3)))
+	if !errors.Is(err, ErrTooManyRedirects) {
+		t.Fatalf("Do = %v, want ErrTooManyRedirects", err)
+	}
+	if !strings.Contains(err.Error(), "stopped after 3") {
+		t.Errorf("%q doesn't say where it stopped", err)
+	}
+}
+
+func ptr(p RedirectPolicy) *RedirectPolicy {
+	return &p
+}
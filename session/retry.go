@@ -0,0 +1,219 @@
+package session
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RetryPolicy decides which failed requests a Session sends again, and how long it waits between tries
+type RetryPolicy struct {
+	MaxAttempts      int           // Tries including the first, 1 or less never retries
+	Methods          []string      // Methods retried after a network error or retryable status
+	StatusCodes      []int         // Responses worth retrying
+	RetryUnprocessed bool          // Also retry any method on 429 and 503, which usually mean the store didn't process the request. Not a promise, see WithRetryPolicy.
+	BaseDelay        time.Duration // Backoff before the first retry, doubling after each one
+	MaxDelay         time.Duration // Cap on a single backoff, 0 for none. Retry-After can ask for longer.
+	MaxElapsed       time.Duration // Give up once this long has passed since the first try, 0 for no limit
+	AttemptTimeout   time.Duration // Limit on each try, including reading the body, 0 for no limit
+}
+
+// DefaultRetryPolicy retries idempotent requests on network errors, 429, 502 and 503
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:      4,
+		Methods:          []string{http.MethodGet, http.MethodHead, http.MethodOptions},
+		StatusCodes:      []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable},
+		RetryUnprocessed: true,
+		BaseDelay:        250 * time.Millisecond,
+		MaxDelay:         5 * time.Second,
+		MaxElapsed:       30 * time.Second,
+		AttemptTimeout:   10 * time.Second,
+	}
+}
+
+// NoRetries sends every request once
+func NoRetries() RetryPolicy {
+	return RetryPolicy{MaxAttempts: 1, AttemptTimeout: 10 * time.Second}
+}
+
+type retryKey struct{}
+
+// WithRetryPolicy returns req sent under policy instead of the session's, e.g.
+// NoRetries for a request that must never be sent twice
+func WithRetryPolicy(req *http.Request, policy RetryPolicy) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), retryKey{}, policy))
+}
+
+func (p RetryPolicy) retryMethod(method string) bool {
+	for _, m := range p.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// retryable says whether a try that ended with resp or err is worth sending again
+func (p RetryPolicy) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		// Stopping the task isn't a failure to retry
+		if errors.Is(err, req.Context().Err()) && req.Context().Err() != nil {
+			return false
+		}
+		if untrusted(err) {
+			return false
+		}
+		return p.retryMethod(req.Method)
+	}
+	for _, code := range p.StatusCodes {
+		if resp.StatusCode != code {
+			continue
+		}
+		if p.retryMethod(req.Method) {
+			return true
+		}
+		return p.RetryUnprocessed && (code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable)
+	}
+	return false
+}
+
+// untrusted reports a certificate that failed verification, which a retry won't fix
+func untrusted(err error) bool {
+	var unknown x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	return errors.As(err, &unknown) || errors.As(err, &hostname) || errors.As(err, &invalid)
+}
+
+// backoff is the wait before retry n (from 1), exponential with jitter so tasks
+// that failed together don't retry together
+func (p RetryPolicy) backoff(n int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < n && d > 0 && d < math.MaxInt64/2; i++ {
+		if p.MaxDelay > 0 && d >= p.MaxDelay {
+			break
+		}
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryAfter reads a Retry-After header in seconds or as an HTTP date, 0 when there is none
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// retryTransport sends requests again according to the session's policy, or the
+// one set on the request with WithRetryPolicy
+type retryTransport struct {
+	next    http.RoundTripper
+	policy  RetryPolicy
+	logger  *zap.Logger
+	retries *int64
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	policy := t.policy
+	if p, ok := req.Context().Value(retryKey{}).(RetryPolicy); ok {
+		policy = p
+	}
+
+	start := time.Now()
+	for n := 1; ; n++ {
+		resp, err := t.try(req, policy.AttemptTimeout)
+		// A body that can't be rewound can't be sent twice
+		rewindable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+		if n >= policy.MaxAttempts || !rewindable || !policy.retryable(req, resp, err) {
+			return resp, err
+		}
+
+		delay := policy.backoff(n)
+		if wait := retryAfter(resp); wait > delay {
+			delay = wait
+		}
+		if policy.MaxElapsed > 0 && time.Since(start)+delay > policy.MaxElapsed {
+			return resp, err
+		}
+
+		reason := zap.Error(err)
+		if err == nil {
+			reason = zap.Int("Status code", resp.StatusCode)
+			resp.Body.Close()
+		}
+		atomic.AddInt64(t.retries, 1)
+		t.logger.Info("Retrying request", zap.String("Method", req.Method), zap.String("URL", req.URL.String()), zap.Int("Attempt", n+1), reason, zap.Duration("Delay", delay))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// try sends the request once under timeout, 0 for none. The timeout keeps
+// running until the response body is closed.
+func (t *retryTransport) try(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		return t.next.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,211 @@
+package session
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	// The delay before jitter doubles from BaseDelay up to MaxDelay
+	ceilings := []time.Duration{100, 200, 400, 800, 1000, 1000, 1000}
+	for i, ceiling := range ceilings {
+		n := i + 1
+		ceiling *= time.Millisecond
+		for try := 0; try < 100; try++ {
+			if d := policy.backoff(n); d < ceiling/2 || d > ceiling {
+				t.Fatalf("backoff(%d) = %s, want between %s and %s", n, d, ceiling/2, ceiling)
+			}
+		}
+	}
+
+	if d := (RetryPolicy{}).backoff(3); d != 0 {
+		t.Errorf("backoff without a BaseDelay = %s, want 0", d)
+	}
+	// No MaxDelay means no cap
+	if d := (RetryPolicy{BaseDelay: time.Second}).backoff(4); d < 4*time.Second {
+		t.Errorf("uncapped backoff(4) = %s, want at least 4s", d)
+	}
+	if d := (RetryPolicy{BaseDelay: time.Second}).backoff(100); d <= 0 {
+		t.Errorf("backoff(100) overflowed to %s", d)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		value    string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"3", 3 * time.Second, 3 * time.Second},
+		{"0", 0, 0},
+		{"-5", 0, 0},
+		{"soon", 0, 0},
+		// HTTP dates only have whole seconds
+		{time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat), 8 * time.Second, 10 * time.Second},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), -2 * time.Minute, 0},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.value != "" {
+			resp.Header.Set("Retry-After", tt.value)
+		}
+		if got := retryAfter(resp); got < tt.min || got > tt.max {
+			t.Errorf("retryAfter(%q) = %s, want between %s and %s", tt.value, got, tt.min, tt.max)
+		}
+	}
+	if got := retryAfter(nil); got != 0 {
+		t.Errorf("retryAfter(nil) = %s, want 0", got)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	policy := DefaultRetryPolicy()
+	tests := []struct {
+		name   string
+		method string
+		ctx    context.Context
+		status int
+		err    error
+		want   bool
+	}{
+		{"GET 503", http.MethodGet, nil, http.StatusServiceUnavailable, nil, true},
+		{"GET 502", http.MethodGet, nil, http.StatusBadGateway, nil, true},
+		{"GET 404", http.MethodGet, nil, http.StatusNotFound, nil, false},
+		{"POST 429 wasn't processed", http.MethodPost, nil, http.StatusTooManyRequests, nil, true},
+		{"POST 503 wasn't processed", http.MethodPost, nil, http.StatusServiceUnavailable, nil, true},
+		{"POST 502 may have been processed", http.MethodPost, nil, http.StatusBadGateway, nil, false},
+		{"GET network error", http.MethodGet, nil, 0, errors.New("connection reset"), true},
+		{"POST network error", http.MethodPost, nil, 0, errors.New("connection reset"), false},
+		{"stopped", http.MethodGet, cancelled, 0, context.Canceled, false},
+		{"untrusted certificate", http.MethodGet, nil, 0, x509.UnknownAuthorityError{}, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "https://shop.example.com/", nil)
+		if tt.ctx != nil {
+			req = req.WithContext(tt.ctx)
+		}
+		var resp *http.Response
+		if tt.err == nil {
+			resp = &http.Response{StatusCode: tt.status}
+		}
+		if got := policy.retryable(req, resp, tt.err); got != tt.want {
+			t.Errorf("%s: retryable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	policy.RetryUnprocessed = false
+	req := httptest.NewRequest(http.MethodPost, "https://shop.example.com/", nil)
+	if policy.retryable(req, &http.Response{StatusCode: http.StatusTooManyRequests}, nil) {
+		t.Error("POST 429 retried without RetryUnprocessed")
+	}
+}
+
+// newRetryServer answers the first limited requests with 429 and Retry-After,
+// checking every try carries the same body
+func newRetryServer(t *testing.T, limited int32, retryAfter string) (*httptest.Server, *int32) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "id=40000000000002" {
+			t.Errorf("try %d sent body %q", atomic.LoadInt32(&hits)+1, body)
+		}
+		if atomic.AddInt32(&hits, 1) <= limited {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestRetryTransportRetryAfter(t *testing.T) {
+	srv, hits := newRetryServer(t, 1, "1")
+
+	var retries int64
+	policy := DefaultRetryPolicy()
+	policy.BaseDelay = time.Millisecond
+	client := &http.Client{Transport: &retryTransport{next: http.DefaultTransport, policy: policy, logger: zap.NewNop(), retries: &retries}}
+
+	start := time.Now()
+	resp, err := client.Post(srv.URL, "application/x-www-form-urlencoded", strings.NewReader("id=40000000000002"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Retry-After asks for longer than the backoff, so it wins
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want Retry-After's 1s", elapsed)
+	}
+	if resp.StatusCode != http.StatusOK || atomic.LoadInt32(hits) != 2 || retries != 1 {
+		t.Errorf("status %d after %d tries and %d retries, want 200 after 2 and 1", resp.StatusCode, *hits, retries)
+	}
+}
+
+func TestRetryTransportGivesUp(t *testing.T) {
+	// A Retry-After past MaxElapsed returns the 429 straight away
+	srv, hits := newRetryServer(t, 10, "60")
+	var retries int64
+	policy := DefaultRetryPolicy()
+	policy.MaxElapsed = 5 * time.Second
+	client := &http.Client{Transport: &retryTransport{next: http.DefaultTransport, policy: policy, logger: zap.NewNop(), retries: &retries}}
+
+	start := time.Now()
+	resp, err := client.Post(srv.URL, "application/x-www-form-urlencoded", strings.NewReader("id=40000000000002"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || atomic.LoadInt32(hits) != 1 || time.Since(start) > time.Second {
+		t.Errorf("status %d after %d tries in %s, want the first 429 back", resp.StatusCode, *hits, time.Since(start))
+	}
+
+	// MaxAttempts bounds the tries
+	srv, hits = newRetryServer(t, 10, "0")
+	policy = DefaultRetryPolicy()
+	policy.BaseDelay = time.Millisecond
+	policy.MaxAttempts = 3
+	client.Transport = &retryTransport{next: http.DefaultTransport, policy: policy, logger: zap.NewNop(), retries: &retries}
+	resp, err = client.Post(srv.URL, "application/x-www-form-urlencoded", strings.NewReader("id=40000000000002"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || atomic.LoadInt32(hits) != 3 {
+		t.Errorf("status %d after %d tries, want 429 after 3", resp.StatusCode, *hits)
+	}
+}
+
+func TestWithRetryPolicy(t *testing.T) {
+	srv, hits := newRetryServer(t, 1, "0")
+	var retries int64
+	client := &http.Client{Transport: &retryTransport{next: http.DefaultTransport, policy: DefaultRetryPolicy(), logger: zap.NewNop(), retries: &retries}}
+
+	// The session would retry a POST's 429, the request opts out
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader("id=40000000000002"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(WithRetryPolicy(req, NoRetries()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || atomic.LoadInt32(hits) != 1 || retries != 0 {
+		t.Errorf("status %d after %d tries and %d retries, want the 429 after 1", resp.StatusCode, *hits, retries)
+	}
+}
@@ -6,71 +6,49 @@ import (
 	"encoding/json"
 	"fmt"
 	browser "github.com/EDDYCJY/fake-useragent"
+	"io"
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
-	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 )
 
 type Session struct {
-	Client    *http.Client
-	Useragent string
-	Transport *http.Transport
-	logger    *zap.Logger
+	Useragent  string
+	client     *http.Client
+	transport  *http.Transport
+	jar        *cookieJar // Nil if it couldn't be created
+	logger     *zap.Logger
+	base       http.RoundTripper // transport unless replaced with SetTransport
+	doer       Doer              // Replaces client when set with SetDoer
+	middleware []Middleware
+	send       Doer         // client or doer wrapped in middleware, what Do sends with
+	recorder   *HARRecorder // Nil unless recording
+	retry      RetryPolicy
+	retries    int64
+	limitWait  int64                                 // Nanoseconds spent waiting on host limits
+	onLimit    func(host string, wait time.Duration) // Nil unless set with OnLimiterWait
+	overrides  map[string]*url.URL                   // Base URLs set with OverrideHost, keyed by host
 }
 
-func (s Session) UserAgent() string {
+func (s *Session) UserAgent() string {
 	return s.Useragent
 }
 
-func NewLogger() *zap.Logger {
-	// info level enabler
-	infoLevel := zap.LevelEnablerFunc(func(level zapcore.Level) bool {
-		return level == zapcore.InfoLevel
-	})
-
-	// error and fatal level enabler
-	errorFatalLevel := zap.LevelEnablerFunc(func(level zapcore.Level) bool {
-		return level == zapcore.ErrorLevel || level == zapcore.FatalLevel
-	})
-
-	// write syncers
-	stdoutSyncer := zapcore.Lock(os.Stdout)
-	stderrSyncer := zapcore.Lock(os.Stderr)
-
-	// tee core
-	core := zapcore.NewTee(
-		zapcore.NewCore(
-			zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
-			stdoutSyncer,
-			infoLevel,
-		),
-		zapcore.NewCore(
-			zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
-			stderrSyncer,
-			errorFatalLevel,
-		),
-	)
-
-	// finally construct the logger with the tee core
-	logger := zap.New(core)
-
-	return logger
-}
-
 // dc.smartproxy.com:10001:user-OskarU-country-gb:xjChiur25bwLFEm0q3
 // dc.smartproxy.com:10002:user-OskarU-country-gb:xjChiur25bwLFEm0q3
 // dc.smartproxy.com:10003:user-OskarU-country-gb:xjChiur25bwLFEm0q3
-// Constructor
-func NewSession(options data_handling.Options) *Session {
+// Constructor. A nil logger discards the session's logs.
+func NewSession(options data_handling.Options, logger *zap.Logger) *Session {
 	sess := new(Session)
 	sess.Useragent = browser.Chrome()
-	sess.logger = NewLogger()
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	sess.logger = logger
 
 	// Setup transport
 	t := http.DefaultTransport.(*http.Transport).Clone()
@@ -87,125 +65,176 @@ func NewSession(options data_handling.Options) *Session {
 		})
 		t.Proxy = proxy
 	}
-	sess.Transport = t
+	sess.transport = t
+
+	// Setup client. Timeouts are per try, see RetryPolicy.AttemptTimeout. Redirects
+	// aren't followed unless the request asks with WithRedirects.
+	sess.client = &http.Client{
+		CheckRedirect: checkRedirect,
+	}
 
 	// Setup cookiejar
-	jar, err := cookiejar.New(nil)
+	jar, err := newCookieJar()
 
 	if err != nil {
 		sess.logger.Error("Error creating cookiejar", zap.Error(err))
+	} else {
+		sess.jar = jar
+		sess.client.Jar = jar
 	}
-
-	// Setup client
-	sess.Client = &http.Client{
-		Timeout:   10 * time.Second,
-		Transport: t,
-		Jar:       jar,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
+	sess.base = t
+	sess.retry = DefaultRetryPolicy()
+	sess.rebuild()
 
 	return sess
 }
 
-func (s Session) Get(url string, headers map[string][]string) (resp *http.Response, err error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		//Handle Error
-		s.logger.Error("Error creating request", zap.Error(err))
-	}
+// SetTransport replaces the transport requests are finally sent with, e.g. to
+// talk to a test server. Retries and recording still apply.
+func (s *Session) SetTransport(rt http.RoundTripper) {
+	s.base = rt
+	s.rebuild()
+}
 
-	if len(headers) != 0 {
-		fmt.Print("Headers set")
-		req.Header = http.Header(headers)
+// SetRetryPolicy replaces the session's retry policy
+func (s *Session) SetRetryPolicy(policy RetryPolicy) {
+	s.retry = policy
+	s.rebuild()
+}
+
+// Retries is the number of requests the session has sent again
+func (s *Session) Retries() int64 {
+	return atomic.LoadInt64(&s.retries)
+}
+
+// LimiterWait is the total time the session's requests have waited on host limits
+func (s *Session) LimiterWait() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.limitWait))
+}
+
+// OnLimiterWait calls fn each time a request has to wait on its host's limit, before waiting
+func (s *Session) OnLimiterWait(fn func(host string, wait time.Duration)) {
+	s.onLimit = fn
+	s.rebuild()
+}
+
+// Backoff is how long to wait before starting a whole flow again after n failures,
+// on the same schedule as retried requests
+func (s *Session) Backoff(n int) time.Duration {
+	return s.retry.backoff(n)
+}
+
+// rebuild stacks the client's transport: retries, then host limits, then recording,
+// then decoding, then host overrides, then the base transport, so every try is
+// limited and recorded decoded and with the store's URL. Middleware goes around the client.
+func (s *Session) rebuild() {
+	rt := s.base
+	if len(s.overrides) > 0 {
+		rt = &overrideTransport{next: rt, hosts: s.overrides}
 	}
+	rt = &decodeTransport{next: rt}
+	if s.recorder != nil {
+		s.recorder.base = rt
+		rt = s.recorder
+	}
+	rt = &rateLimitTransport{next: rt, waited: &s.limitWait, onWait: s.onLimit}
+	s.client.Transport = &retryTransport{next: rt, policy: s.retry, logger: s.logger, retries: &s.retries}
 
-	req.Header.Set("User-Agent", s.Useragent)
+	var send Doer = s.client
+	if s.doer != nil {
+		send = s.doer
+	}
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		send = s.middleware[i](send)
+	}
+	s.send = send
+}
 
-	res, err := s.Client.Do(req)
+// Do sends req, returning a *TransportError when there is no response. The
+// response body must be closed when err is nil. Redirects are followed as set
+// with WithRedirects, see RedirectChain for the requests that were made.
+func (s *Session) Do(req *http.Request) (*http.Response, error) {
+	resp, err := s.send.Do(req)
 	if err != nil {
-		//Handle Error
-		s.logger.Error("Error sending request", zap.Error(err))
+		return nil, transportError(req, err)
 	}
-
-	return res, err
+	// Fake Doers often leave it out, Landed and errors need it
+	if resp.Request == nil {
+		resp.Request = req
+	}
+	if chain := RedirectChain(resp); len(chain) > 1 {
+		hops := make([]string, len(chain))
+		for i, hop := range chain {
+			hops[i] = hop.String()
+		}
+		s.logger.Debug("Followed redirects", zap.Strings("Chain", hops))
+	}
+	return resp, nil
 }
 
-func (s Session) Post(url string, headers map[string][]string, body string) (resp *http.Response, err error) {
-	parsedBody := strings.NewReader(body)
-	req, err := http.NewRequest("POST", url, parsedBody)
+func (s *Session) Get(url string, headers map[string][]string) (resp *http.Response, err error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		//Handle Error
-		s.logger.Error("Error creating request", zap.Error(err))
+		return nil, err
 	}
 	if len(headers) != 0 {
-		fmt.Print("Headers set")
 		req.Header = http.Header(headers)
 	}
 	req.Header.Set("User-Agent", s.Useragent)
-	res, err := s.Client.Do(req)
+	return s.doLogged(req)
+}
+
+func (s *Session) Post(url string, headers map[string][]string, body string) (resp *http.Response, err error) {
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
 	if err != nil {
-		//Handle Error
-		s.logger.Error("Error sending request", zap.Error(err))
+		return nil, err
 	}
-	return res, err
+	if len(headers) != 0 {
+		req.Header = http.Header(headers)
+	}
+	req.Header.Set("User-Agent", s.Useragent)
+	return s.doLogged(req)
 }
 
-func (s Session) PostJson(url string, headers map[string][]string, body map[string]interface{}) (resp *http.Response, err error) {
-	req := new(http.Request)
+func (s *Session) PostJson(url string, headers map[string][]string, body map[string]interface{}) (resp *http.Response, err error) {
+	var reader io.Reader
 	if body != nil {
 		jsonData, err := json.Marshal(body)
 		if err != nil {
-			fmt.Printf("could not marshal json: %s\n", err)
-			return nil, err
+			return nil, fmt.Errorf("Could not marshal json: %w", err)
 		}
-		req, err = http.NewRequest("POST", url, bytes.NewReader(jsonData))
-	} else {
-		req, err = http.NewRequest("POST", url, nil)
+		reader = bytes.NewReader(jsonData)
 	}
-
+	req, err := http.NewRequest(http.MethodPost, url, reader)
 	if err != nil {
-		//Handle Error
-		s.logger.Error("Error creating request", zap.Error(err))
+		return nil, err
 	}
-
 	if len(headers) != 0 {
-		fmt.Print("Headers set")
 		req.Header = http.Header(headers)
 	}
-
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("User-Agent", s.Useragent)
-
-	res, err := s.Client.Do(req)
-
-	if err != nil {
-		//Handle Error
-		s.logger.Error("Error sending request", zap.Error(err))
-	}
-
-	return res, err
+	return s.doLogged(req)
 }
 
-func (s Session) PostForm(url string, headers map[string][]string, form url.Values) (resp *http.Response, err error) {
-	parsedBody := strings.NewReader(form.Encode())
-	req, err := http.NewRequest("POST", url, parsedBody)
+func (s *Session) PostForm(url string, headers map[string][]string, form url.Values) (resp *http.Response, err error) {
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(form.Encode()))
 	if err != nil {
-		//Handle Error
-		s.logger.Error("Error creating request", zap.Error(err))
+		return nil, err
 	}
 	if len(headers) != 0 {
-		fmt.Print("Headers set")
 		req.Header = http.Header(headers)
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Set("User-Agent", s.Useragent)
-	res, err := s.Client.Do(req)
+	return s.doLogged(req)
+}
 
+// doLogged is Do with the failure logged, for the helpers above
+func (s *Session) doLogged(req *http.Request) (*http.Response, error) {
+	resp, err := s.Do(req)
 	if err != nil {
-		//Handle Error
 		s.logger.Error("Error sending request", zap.Error(err))
 	}
-	return res, err
+	return resp, err
 }
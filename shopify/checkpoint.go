@@ -0,0 +1,207 @@
+package shopify
+
+import (
+	"alin/packages/session"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Bump when Checkpoint changes, older checkpoints are thrown away rather than misread
+const checkpointVersion = 1
+
+// Checkpoint is how far a checkout got, saved after every step so a task restarted
+// after a crash can carry on from there. Card details are never written here.
+type Checkpoint struct {
+	Version        int                  `json:"version"`
+	TaskID         int                  `json:"taskId"`
+	URL            string               `json:"url"`  // The task's product URL, a checkpoint for another product is ignored
+	Size           string               `json:"size"` // As above for the size
+	Step           string               `json:"step"` // Name of the last step that completed
+	SavedAt        time.Time            `json:"savedAt"`
+	VariantID      string               `json:"variantId"`
+	Tokens         Tokens               `json:"tokens"`
+	Cart           Cart                 `json:"cart"`
+	ShippingRate   ShippingRate         `json:"shippingRate"`
+	TotalPrice     float64              `json:"totalPrice"`
+	PaymentGateway string               `json:"paymentGateway"`
+	Cookies        []session.SetCookies `json:"cookies"`
+}
+
+// LoadCheckpoint reads a checkpoint. A missing file is nil, not an error.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("Could not read %s: %w", path, err)
+	}
+	return &cp, nil
+}
+
+// paymentMayBeSent reports a checkpoint saved after the payment session was
+// created, so the payment itself may have reached the store
+func (cp *Checkpoint) paymentMayBeSent() bool {
+	return cp.Step == "payment_session" || cp.Step == "payment"
+}
+
+// checkpointFile is where the task's checkpoint is kept in dir
+func checkpointFile(dir string, taskID int) string {
+	return filepath.Join(dir, fmt.Sprintf("task-%d.json", taskID))
+}
+
+// checkpoint saves the task's progress after step. A failed save is logged rather
+// than failing the checkout, which can still finish without it.
+func (inst *Instance) checkpoint(step string) {
+	if inst.checkpointPath == "" {
+		return
+	}
+	data, err := json.MarshalIndent(Checkpoint{
+		Version:        checkpointVersion,
+		TaskID:         inst.TaskID,
+		URL:            inst.Options.URL,
+		Size:           inst.Options.Size,
+		Step:           step,
+		SavedAt:        time.Now(),
+		VariantID:      inst.VariantID,
+		Tokens:         inst.Tokens,
+		Cart:           inst.Cart,
+		ShippingRate:   inst.ShippingRate,
+		TotalPrice:     inst.TotalPrice,
+		PaymentGateway: inst.PaymentGateway,
+		Cookies:        inst.Session.SavedCookies(),
+	}, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(inst.checkpointPath, data)
+	}
+	if err != nil {
+		inst.Logger.Error("Error saving checkpoint", zap.Error(err))
+	}
+}
+
+// clearCheckpoint removes the task's checkpoint, once it's finished or starting over
+func (inst *Instance) clearCheckpoint() {
+	if inst.checkpointPath == "" {
+		return
+	}
+	if err := os.Remove(inst.checkpointPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		inst.Logger.Error("Error removing checkpoint", zap.Error(err))
+	}
+}
+
+// resume restores the task's checkpoint if its checkout can still be finished,
+// returning the step to carry on after, or "" to start over. done is true when
+// the checkout turns out to have completed before the restart. A checkout whose
+// payment was sent before the restart is never started over: resume waits for
+// it to finish, and err is why it didn't.
+func (inst *Instance) resume() (after string, done bool, err error) {
+	if inst.checkpointPath == "" {
+		return "", false, nil
+	}
+	cp, err := LoadCheckpoint(inst.checkpointPath)
+	if err != nil {
+		inst.Logger.Info("Could not load checkpoint, starting over", zap.Error(err))
+		return "", false, nil
+	}
+	if cp == nil {
+		return "", false, nil
+	}
+	// Nothing before the checkout is worth keeping without it
+	if cp.Version != checkpointVersion || cp.TaskID != inst.TaskID || cp.URL != inst.Options.URL ||
+		cp.Size != inst.Options.Size || cp.Tokens.ShopifyCheckoutToken == "" {
+		inst.clearCheckpoint()
+		return "", false, nil
+	}
+
+	if err := inst.Session.RestoreCookies(cp.Cookies); err != nil {
+		inst.Logger.Info("Could not restore cookies, starting over", zap.Error(err))
+		return "", false, nil
+	}
+	variantID := inst.VariantID
+	inst.VariantID = cp.VariantID
+	inst.Tokens = cp.Tokens
+	inst.Cart = cp.Cart
+	inst.ShippingRate = cp.ShippingRate
+	inst.TotalPrice = cp.TotalPrice
+	inst.PaymentGateway = cp.PaymentGateway
+
+	inst.setStatus(StateCheckout, "Checking saved checkout")
+	landed, err := inst.checkoutPage()
+	switch {
+	case err != nil:
+		inst.Logger.Info("Saved checkout can't be resumed, starting over", zap.String("Step", cp.Step), zap.Error(err))
+	case strings.Contains(landed, "/thank_you"):
+		inst.Logger.Info("Saved checkout already completed", zap.String("Step", cp.Step))
+		return cp.Step, true, nil
+	case strings.Contains(landed, "/processing"):
+		inst.Logger.Info("Saved checkout is processing its payment", zap.String("Step", cp.Step))
+		if err := inst.awaitPayment(landed); err != nil {
+			return cp.Step, false, err
+		}
+		return cp.Step, true, nil
+	default:
+		inst.Logger.Info("Resuming checkout", zap.String("Step", cp.Step), zap.Duration("Age", time.Since(cp.SavedAt).Round(time.Second)))
+		return cp.Step, false, nil
+	}
+
+	inst.VariantID = variantID
+	inst.Tokens = Tokens{}
+	inst.Cart = Cart{}
+	inst.ShippingRate = ShippingRate{}
+	inst.TotalPrice = 0
+	inst.PaymentGateway = ""
+	if err := inst.Session.RestoreCookies(nil); err != nil {
+		inst.Logger.Error("Error clearing cookies", zap.Error(err))
+	}
+	inst.clearCheckpoint()
+	return "", false, nil
+}
+
+// checkoutPage loads the checkout to check its token is still good, returning
+// where it landed, which is thank_you or processing once the payment was sent.
+// A live checkout's page gives a fresh authenticity token in place of the saved ones.
+func (inst *Instance) checkoutPage() (string, error) {
+	req, err := inst.newRequest(http.MethodGet, inst.checkoutURL(""), nil, session.PresetNavigate, inst.productURL())
+	if err != nil {
+		return "", err
+	}
+	resp, err := inst.Session.Do(session.WithRedirects(req, session.Follow(maxRedirects)))
+	if err != nil {
+		return "", err
+	}
+	landed := session.Landed(resp)
+	body, err := readBody(resp, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(landed, "/thank_you") || strings.Contains(landed, "/processing") {
+		return landed, nil
+	}
+	if !strings.Contains(landed, "/checkouts/"+inst.Tokens.ShopifyCheckoutToken) || strings.Contains(landed, "/stock_problems") {
+		return "", fmt.Errorf("Checkout redirected to %s", session.Redact(landed))
+	}
+
+	token, err := scrape(body, `name=\"authenticity_token" value="([a-zA-Z0-9_-]+)\"`, "authenticity_token", landed)
+	if err != nil {
+		return "", err
+	}
+	// Loading the page rotated the token, whichever form the checkout posts next needs the new one
+	for _, saved := range []*string{&inst.Tokens.AuthenticityToken, &inst.Tokens.DeliveryAuthenticityToken, &inst.Tokens.CheckoutToken} {
+		if *saved != "" {
+			*saved = token
+		}
+	}
+	return landed, nil
+}
@@ -0,0 +1,136 @@
+package shopify_test
+
+import (
+	"context"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"alin/packages/shopify"
+	"alin/packages/shopify/data_handling"
+	"alin/packages/shopify/shopifytest"
+)
+
+// standInOptions sends a task's requests to srv the way a user would point a task
+// at a local stand-in, so tasks run by a TaskManager reach it
+func standInOptions(t *testing.T, srv *shopifytest.Server) data_handling.Options {
+	t.Helper()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(ca, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return data_handling.Options{
+		URL:     srv.ProductURL(),
+		Size:    "UK 9",
+		Profile: shopifytest.Profile(),
+		BaseURL: srv.URL,
+		CACerts: []string{ca},
+	}
+}
+
+// waitForStatus polls the task until match accepts its info
+func waitForStatus(t *testing.T, m *shopify.TaskManager, id int, match func(shopify.TaskInfo) bool) shopify.TaskInfo {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		info, err := m.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match(info) {
+			return info
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("task stuck at %s", info.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A task stopped while its payment is processing waits for that payment when it
+// starts again, rather than checking out a second time
+func TestResumeWhileProcessing(t *testing.T) {
+	srv := shopifytest.NewServer(shopifytest.SlowProcessing)
+	defer srv.Close()
+	checkpoints := t.TempDir()
+	options := standInOptions(t, srv)
+
+	first := shopify.NewTaskManager(shopify.TaskManagerConfig{Checkpoints: checkpoints})
+	id, err := first.Create(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Start(id); err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, first, id, func(info shopify.TaskInfo) bool {
+		return info.Status.State == shopify.StateProcessing && info.Status.Message == "Processing payment"
+	})
+	// Shutting down is as close to a crash as the manager allows
+	if err := first.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if orders := len(srv.Orders()); orders != 0 {
+		t.Fatalf("%d orders before the restart, want the payment still processing", orders)
+	}
+	if _, err := os.Stat(filepath.Join(checkpoints, "task-1.json")); err != nil {
+		t.Fatalf("no checkpoint left for the restart: %v", err)
+	}
+
+	second := shopify.NewTaskManager(shopify.TaskManagerConfig{Checkpoints: checkpoints})
+	defer second.Shutdown(context.Background())
+	if id, err = second.Create(options); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Start(id); err != nil {
+		t.Fatal(err)
+	}
+	info := waitForStatus(t, second, id, func(info shopify.TaskInfo) bool { return !info.Running })
+
+	if info.Status.State != shopify.StateSuccess {
+		t.Errorf("resumed task ended %s, want Success", info.Status)
+	}
+	if orders := len(srv.Orders()); orders != 1 {
+		t.Errorf("%d orders, want 1", orders)
+	}
+	if checkouts := srv.Hits("/checkout"); checkouts != 1 {
+		t.Errorf("%d checkouts started, want the first one resumed", checkouts)
+	}
+	if _, err := os.Stat(filepath.Join(checkpoints, "task-1.json")); !os.IsNotExist(err) {
+		t.Errorf("checkpoint kept after the checkout finished: %v", err)
+	}
+}
+
+// Restarting a task whose payment is processing waits on that payment, it doesn't
+// throw the checkout away and pay again
+func TestRestartWhileProcessing(t *testing.T) {
+	srv := shopifytest.NewServer(shopifytest.SlowProcessing)
+	defer srv.Close()
+
+	m := shopify.NewTaskManager(shopify.TaskManagerConfig{Checkpoints: t.TempDir()})
+	defer m.Shutdown(context.Background())
+	id, err := m.Create(standInOptions(t, srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(id); err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, m, id, func(info shopify.TaskInfo) bool {
+		return info.Status.State == shopify.StateProcessing && info.Status.Message == "Processing payment"
+	})
+	if err := m.Restart(id); err != nil {
+		t.Fatal(err)
+	}
+	info := waitForStatus(t, m, id, func(info shopify.TaskInfo) bool { return !info.Running })
+
+	if info.Status.State != shopify.StateSuccess {
+		t.Errorf("restarted task ended %s, want Success", info.Status)
+	}
+	if orders, checkouts := len(srv.Orders()), srv.Hits("/checkout"); orders != 1 || checkouts != 1 {
+		t.Errorf("%d orders from %d checkouts, want 1 from 1", orders, checkouts)
+	}
+}
@@ -1,21 +1,38 @@
 package data_handling
 
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
 type ProxyDefiniton struct {
-	Protocol string
-	Host     string
-	Port     string
-	Username string
-	Password string
+	Protocol string `json:"protocol"`
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
 type Options struct {
-	TaskID    int
-	URL       string
-	VariantID string
-	UseProxy  bool
-	Proxy     ProxyDefiniton
-	Profile   CheckoutProfile
-	Size      string
+	TaskID           int
+	URL              string // Product URL or bare product handle
+	Domain           string // Store domain, only needed when URL is a bare handle
+	VariantID        string // Skips the product page when set
+	UseProxy         bool
+	Proxy            ProxyDefiniton
+	Profile          CheckoutProfile
+	ProfileName      string // Resolved to Profile when the task starts
+	Size             string
+	ShippingStrategy string        // "first", "cheapest" or text to match in the rate title
+	StartAt          time.Time     // Store time to start checking out, zero starts straight away
+	PrewarmLead      time.Duration // How long before StartAt to open connections to the store, 0 for the default, negative to skip
+	MaxAttempts      int           // Checkout attempts before the task gives up, 0 to keep trying until stopped
+	ReplayHAR        string        // Answer requests from this recorded HAR file instead of the store
+	BaseURL          string        // Send the store's requests here instead, e.g. "https://localhost:8443" for a local stand-in
+	CACerts          []string      // PEM files of CA certificates to trust on top of the system's
 }
 
 type CardDetails struct {
@@ -29,7 +46,38 @@ type CardDetails struct {
 	IssueNumber       string      `json:"issue_number"`
 }
 
+// MaskCardNumber keeps only the last four digits, e.g. "**** **** **** 1234"
+func MaskCardNumber(number string) string {
+	digits := stripSeparators(number)
+	if len(digits) < 4 {
+		return strings.Repeat("*", len(digits))
+	}
+	return "**** **** **** " + digits[len(digits)-4:]
+}
+
+// Masked returns the card with its number masked and CVV removed, safe to show in the UI
+func (c CardDetails) Masked() CardDetails {
+	c.Number = MaskCardNumber(c.Number)
+	c.VerificationValue = ""
+	return c
+}
+
+// String never includes the full number or the CVV, so printing a card can't leak it
+func (c CardDetails) String() string {
+	return fmt.Sprintf("%s %s %s/%s", c.Name, MaskCardNumber(c.Number), c.Month, c.Year)
+}
+
+// MarshalLogObject logs the card masked, e.g. zap.Object("Card", card)
+func (c CardDetails) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("number", MaskCardNumber(c.Number))
+	enc.AddString("name", c.Name)
+	enc.AddString("month", c.Month)
+	enc.AddString("year", c.Year)
+	return nil
+}
+
 type CheckoutProfile struct {
+	Name     string // Label that saved tasks use to refer to the profile
 	Email    string
 	Country  string
 	Fname    string
@@ -41,112 +89,3 @@ type CheckoutProfile struct {
 	Phone    string
 	Card     CardDetails
 }
-
-func NewProfile() CheckoutProfile {
-	cc := CardDetails{
-		Number:            "5375 9000 3932 8312",
-		Name:              "MR O J URBANIAK",
-		StartMonth:        nil,
-		StartYear:         nil,
-		Month:             "05",
-		Year:              "2025",
-		VerificationValue: "315",
-		IssueNumber:       "",
-	}
-	//106 originally
-
-	return CheckoutProfile{
-		Email:    "markbania111@gmail.com",
-		Country:  "United Kingdom",
-		Fname:    "Marek",
-		Lname:    "Urbaniak",
-		Address1: "36 Gloucester Road",
-		Address2: "",
-		City:     "Shrewsbury",
-		Zipcode:  "SY13PJ",
-		Phone:    "7928983220",
-		Card:     cc,
-	}
-}
-
-func Dylan() CheckoutProfile {
-	cc := CardDetails{
-		Number:            "5356 7434 8171 8942",
-		Name:              "OJ URBAN",
-		StartMonth:        nil,
-		StartYear:         nil,
-		Month:             "08",
-		Year:              "2032",
-		VerificationValue: "450",
-		IssueNumber:       "",
-	}
-	//106 originally
-
-	return CheckoutProfile{
-		Email:    "dylww659@gmail.com",
-		Country:  "United Kingdom",
-		Fname:    "Dylan",
-		Lname:    "Williams",
-		Address1: "11 Milner Road",
-		Address2: "",
-		City:     "Liverpool",
-		Zipcode:  "L170AB",
-		Phone:    "7928983267",
-		Card:     cc,
-	}
-}
-
-func Katarzyna() CheckoutProfile {
-	cc := CardDetails{
-		Number:            "5356 7431 5170 0766",
-		Name:              "OSKAR J URBANIAK",
-		StartMonth:        nil,
-		StartYear:         nil,
-		Month:             "08",
-		Year:              "2032",
-		VerificationValue: "106",
-		IssueNumber:       "",
-	}
-	//106 originally
-
-	return CheckoutProfile{
-		Email:    "katarzyna320193gogo@gmail.com",
-		Country:  "United Kingdom",
-		Fname:    "Katarzyna",
-		Lname:    "Michalak",
-		Address1: "19 Stersacre Road",
-		Address2: "",
-		City:     "Shrewsbury",
-		Zipcode:  "SY13PW",
-		Phone:    "7928983330",
-		Card:     cc,
-	}
-}
-
-//func (p CheckoutProfile) CardJson() string {
-//	return `{"credit_card":{"number":"` + p.CC_NUM + `","name":"` + p.CC_NAME + `","month":"` + p.CC_EXP_M + `","year":"` + p.CC_EXP_YYYY + `","verification_value":"` + p.CC_CVV + `"}}`
-//	return p.Email
-//}
-
-//# TestProf = Profile(
-//#     email="worky.wor.k899@gmail.com",
-//#     country="United Kingdom",
-//#     fname="DYLAN",
-//#     lname="Williams",
-//#     address1="11 Milner Road",
-//#     address2="",
-//#     city="Liverpool",
-//#     zipcode="L170AB",
-//#     phone="07928988776",
-//#     ccnum="5354 5680 7405 8238",
-//#     ccexp_m="8",
-//#     ccexp_yyyy="2028",
-//#     cvv="366",
-//#     ccname="DYLAN WILLIAMS",
-//# )
-//# route_one_instance = Shopify(
-//#     "https://launches.routeone.co.uk/products/nike-sb-yuto-dunk-low-pro-qs-skate-shoes-wolf-grey-iron-grey-sail",
-//#     profile=TestProf,
-//#     variant_id=42881781858475,
-//# )
-//# route_one_instance.test_cart()
@@ -0,0 +1,21 @@
+package data_handling
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const appDirName = "Alin-Go"
+
+// AppDataPath returns the path of name inside the app's data directory, creating the directory if needed
+func AppDataPath(name string) (string, error) {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(base, appDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
@@ -0,0 +1,309 @@
+package data_handling
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+type ProfileFormat string
+
+const (
+	FormatCSV  ProfileFormat = "csv"
+	FormatJSON ProfileFormat = "json"
+)
+
+// Canonical column names, used for export and as the targets of a ColumnMapping
+var profileColumns = []string{
+	"name", "email", "country", "first_name", "last_name", "address1", "address2",
+	"city", "zipcode", "phone", "card_number", "card_name", "card_month", "card_year", "card_cvv",
+}
+
+// Spreadsheet headers we've seen in the wild, lower case without spaces or punctuation
+var columnAliases = map[string]string{
+	"profile": "name", "profilename": "name", "label": "name",
+	"emailaddress": "email", "mail": "email",
+	"countryname": "country",
+	"firstname": "first_name", "fname": "first_name", "forename": "first_name",
+	"lastname": "last_name", "lname": "last_name", "surname": "last_name",
+	"address": "address1", "addressline1": "address1", "address1": "address1", "street": "address1",
+	"addressline2": "address2", "address2": "address2",
+	"town": "city",
+	"postcode": "zipcode", "zip": "zipcode", "postalcode": "zipcode",
+	"phonenumber": "phone", "mobile": "phone", "telephone": "phone",
+	"cardnumber": "card_number", "ccnum": "card_number", "cardno": "card_number", "pan": "card_number",
+	"nameoncard": "card_name", "cardholder": "card_name", "cardname": "card_name", "ccname": "card_name",
+	"expmonth": "card_month", "expirymonth": "card_month", "cardmonth": "card_month", "ccexpm": "card_month",
+	"expyear": "card_year", "expiryyear": "card_year", "cardyear": "card_year", "ccexpyyyy": "card_year",
+	"cvv": "card_cvv", "cvc": "card_cvv", "securitycode": "card_cvv", "cardcvv": "card_cvv",
+}
+
+// ColumnMapping maps a source column (CSV header or JSON key) to a canonical profile column.
+// Source columns that aren't mapped are ignored.
+type ColumnMapping map[string]string
+
+// SuggestMapping guesses a mapping for the given source columns, for the user to confirm
+func SuggestMapping(columns []string) ColumnMapping {
+	mapping := ColumnMapping{}
+	for _, column := range columns {
+		key := strings.ToLower(column)
+		key = strings.NewReplacer(" ", "", "_", "", "-", "", ".", "").Replace(key)
+		for _, canonical := range profileColumns {
+			if key == strings.ReplaceAll(canonical, "_", "") {
+				mapping[column] = canonical
+			}
+		}
+		if _, ok := mapping[column]; !ok {
+			if canonical, ok := columnAliases[key]; ok {
+				mapping[column] = canonical
+			}
+		}
+	}
+	return mapping
+}
+
+// RowError lists the problems with one source row. Rows are numbered as a
+// spreadsheet shows them (header is row 1) for CSV, and from 1 for JSON.
+type RowError struct {
+	Row    int          `json:"row"`
+	Errors []FieldError `json:"errors"`
+}
+
+// Duplicate is a row that was skipped because it matches a profile already seen
+type Duplicate struct {
+	Row    int    `json:"row"`
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+type ImportResult struct {
+	Profiles   []CheckoutProfile `json:"profiles"`
+	RowErrors  []RowError        `json:"rowErrors"`
+	Duplicates []Duplicate       `json:"duplicates"`
+}
+
+// ReadColumns returns the source columns of a CSV or JSON file, for the mapping step
+func ReadColumns(r io.Reader, format ProfileFormat) ([]string, error) {
+	header, _, _, err := readRows(r, format)
+	return header, err
+}
+
+// ParseProfiles reads profiles through the mapping, validating each row and
+// skipping duplicates within the file. existing profiles are also checked for duplicates.
+func ParseProfiles(r io.Reader, format ProfileFormat, mapping ColumnMapping, existing []CheckoutProfile) (ImportResult, error) {
+	result := ImportResult{Profiles: []CheckoutProfile{}, RowErrors: []RowError{}, Duplicates: []Duplicate{}}
+
+	header, rows, firstRow, err := readRows(r, format)
+	if err != nil {
+		return result, err
+	}
+	for _, target := range mapping {
+		if !isProfileColumn(target) {
+			return result, fmt.Errorf("Unknown profile column %q in mapping", target)
+		}
+	}
+
+	seenNames := map[string]bool{}
+	seenKeys := map[string]bool{}
+	for _, p := range existing {
+		seenNames[strings.ToLower(p.Name)] = true
+		seenKeys[p.duplicateKey()] = true
+	}
+
+	for i, row := range rows {
+		rowNumber := firstRow + i
+		values := map[string]string{}
+		for col, value := range row {
+			if col >= len(header) {
+				continue
+			}
+			if target, ok := mapping[header[col]]; ok {
+				values[target] = strings.TrimSpace(value)
+			}
+		}
+
+		profile := profileFromColumns(values)
+		if err := profile.Validate(); err != nil {
+			var errs ValidationErrors
+			errors.As(err, &errs)
+			result.RowErrors = append(result.RowErrors, RowError{Row: rowNumber, Errors: errs})
+			continue
+		}
+
+		switch {
+		case seenNames[strings.ToLower(profile.Name)]:
+			result.Duplicates = append(result.Duplicates, Duplicate{rowNumber, profile.Name, "Name already used"})
+			continue
+		case seenKeys[profile.duplicateKey()]:
+			result.Duplicates = append(result.Duplicates, Duplicate{rowNumber, profile.Name, "Same email, card and postcode as another profile"})
+			continue
+		}
+		seenNames[strings.ToLower(profile.Name)] = true
+		seenKeys[profile.duplicateKey()] = true
+		result.Profiles = append(result.Profiles, profile)
+	}
+	return result, nil
+}
+
+// WriteProfiles writes profiles with the canonical columns. Card numbers are
+// masked and CVVs left out unless includeSecrets is set.
+func WriteProfiles(w io.Writer, format ProfileFormat, profiles []CheckoutProfile, includeSecrets bool) error {
+	records := make([]map[string]string, len(profiles))
+	for i, p := range profiles {
+		if !includeSecrets {
+			p.Card = p.Card.Masked()
+		}
+		records[i] = p.columns()
+	}
+
+	switch format {
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(profileColumns); err != nil {
+			return err
+		}
+		for _, record := range records {
+			row := make([]string, len(profileColumns))
+			for i, column := range profileColumns {
+				row[i] = record[column]
+			}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	default:
+		return fmt.Errorf("Unsupported profile format %q", format)
+	}
+}
+
+// readRows returns the header, the data rows and the number of the first data row
+func readRows(r io.Reader, format ProfileFormat) ([]string, [][]string, int, error) {
+	switch format {
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		cr.TrimLeadingSpace = true
+		records, err := cr.ReadAll()
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("Could not read CSV: %w", err)
+		}
+		if len(records) == 0 {
+			return nil, nil, 0, errors.New("CSV file is empty")
+		}
+		// Spreadsheets like to start files with a byte order mark
+		records[0][0] = strings.TrimPrefix(records[0][0], "\ufeff")
+		return records[0], records[1:], 2, nil
+	case FormatJSON:
+		var objects []map[string]interface{}
+		dec := json.NewDecoder(r)
+		// Card numbers stored as JSON numbers would otherwise lose digits as float64
+		dec.UseNumber()
+		if err := dec.Decode(&objects); err != nil {
+			return nil, nil, 0, fmt.Errorf("Could not read JSON, expected an array of objects: %w", err)
+		}
+		keys := map[string]bool{}
+		for _, object := range objects {
+			for key := range object {
+				keys[key] = true
+			}
+		}
+		header := make([]string, 0, len(keys))
+		for key := range keys {
+			header = append(header, key)
+		}
+		sort.Strings(header)
+
+		rows := make([][]string, len(objects))
+		for i, object := range objects {
+			rows[i] = make([]string, len(header))
+			for col, key := range header {
+				if value, ok := object[key]; ok && value != nil {
+					rows[i][col] = fmt.Sprint(value)
+				}
+			}
+		}
+		return header, rows, 1, nil
+	default:
+		return nil, nil, 0, fmt.Errorf("Unsupported profile format %q", format)
+	}
+}
+
+func isProfileColumn(column string) bool {
+	for _, c := range profileColumns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+func profileFromColumns(values map[string]string) CheckoutProfile {
+	p := CheckoutProfile{
+		Name:     values["name"],
+		Email:    values["email"],
+		Country:  values["country"],
+		Fname:    values["first_name"],
+		Lname:    values["last_name"],
+		Address1: values["address1"],
+		Address2: values["address2"],
+		City:     values["city"],
+		Zipcode:  values["zipcode"],
+		Phone:    values["phone"],
+		Card: CardDetails{
+			Number:            values["card_number"],
+			Name:              values["card_name"],
+			Month:             values["card_month"],
+			Year:              values["card_year"],
+			VerificationValue: values["card_cvv"],
+		},
+	}
+	// Spreadsheets drop the leading zero of "05"
+	if len(p.Card.Month) == 1 {
+		p.Card.Month = "0" + p.Card.Month
+	}
+	if p.Name == "" {
+		p.Name = strings.TrimSpace(p.Fname + " " + p.Lname)
+	}
+	return p
+}
+
+func (p CheckoutProfile) columns() map[string]string {
+	return map[string]string{
+		"name":        p.Name,
+		"email":       p.Email,
+		"country":     p.Country,
+		"first_name":  p.Fname,
+		"last_name":   p.Lname,
+		"address1":    p.Address1,
+		"address2":    p.Address2,
+		"city":        p.City,
+		"zipcode":     p.Zipcode,
+		"phone":       p.Phone,
+		"card_number": p.Card.Number,
+		"card_name":   p.Card.Name,
+		"card_month":  p.Card.Month,
+		"card_year":   p.Card.Year,
+		"card_cvv":    p.Card.VerificationValue,
+	}
+}
+
+// duplicateKey identifies the same person and card regardless of profile name.
+// Works on masked cards too since only the last four digits are used.
+func (p CheckoutProfile) duplicateKey() string {
+	number := stripSeparators(p.Card.Number)
+	if len(number) > 4 {
+		number = number[len(number)-4:]
+	}
+	zip := strings.ToUpper(strings.ReplaceAll(p.Zipcode, " ", ""))
+	return strings.ToLower(strings.TrimSpace(p.Email)) + "|" + number + "|" + zip
+}
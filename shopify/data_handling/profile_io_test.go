@@ -0,0 +1,175 @@
+package data_handling
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSuggestMapping(t *testing.T) {
+	columns := []string{"Profile Name", "E-mail", "First Name", "Surname", "Address Line 1", "Post Code", "Mobile", "CC Num", "Exp Month", "Exp Year", "CVC", "Notes"}
+	want := ColumnMapping{
+		"Profile Name":   "name",
+		"E-mail":         "email",
+		"First Name":     "first_name",
+		"Surname":        "last_name",
+		"Address Line 1": "address1",
+		"Post Code":      "zipcode",
+		"Mobile":         "phone",
+		"CC Num":         "card_number",
+		"Exp Month":      "card_month",
+		"Exp Year":       "card_year",
+		"CVC":            "card_cvv",
+	}
+	got := SuggestMapping(columns)
+	if len(got) != len(want) {
+		t.Errorf("SuggestMapping() = %v, want %v", got, want)
+	}
+	for column, canonical := range want {
+		if got[column] != canonical {
+			t.Errorf("%q mapped to %q, want %q", column, got[column], canonical)
+		}
+	}
+}
+
+const profilesCSV = "\ufeffProfile,Email,Country,First Name,Last Name,Address,City,Postcode,Phone,Card Number,Name on Card,Exp Month,Exp Year,CVV\n" +
+	"Main,test@example.com,United Kingdom,Test,Buyer,1 High Street,London,SW1A 1AA,7700900123,4242 4242 4242 4242,TEST BUYER,5,2099,123\n" +
+	"Bad card,other@example.com,United Kingdom,Test,Buyer,1 High Street,London,SW1A 1AA,7700900123,4242 4242 4242 4241,TEST BUYER,12,2099,123\n" +
+	"main,third@example.com,United Kingdom,Test,Buyer,1 High Street,London,SW1A 1AA,7700900123,4111 1111 1111 1111,TEST BUYER,12,2099,123\n" +
+	"Copy,TEST@example.com,United Kingdom,Test,Buyer,2 High Street,London,sw1a1aa,7700900123,4242424242424242,TEST BUYER,12,2099,123\n" +
+	",fourth@example.com,United Kingdom,Ann,Other,3 High Street,London,SW1A 1AA,7700900123,5555 5555 5555 4444,ANN OTHER,12,2099,123\n"
+
+func TestParseProfilesCSV(t *testing.T) {
+	header, err := ReadColumns(strings.NewReader(profilesCSV), FormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != "Profile" {
+		t.Errorf("first column %q, want the byte order mark stripped", header[0])
+	}
+
+	result, err := ParseProfiles(strings.NewReader(profilesCSV), FormatCSV, SuggestMapping(header), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Profiles) != 2 {
+		t.Fatalf("imported %d profiles, want 2: %+v", len(result.Profiles), result)
+	}
+	main := result.Profiles[0]
+	if main.Name != "Main" || main.Fname != "Test" || main.Zipcode != "SW1A 1AA" || main.Card.Number != "4242 4242 4242 4242" {
+		t.Errorf("first profile mapped wrong: %+v", main)
+	}
+	if main.Card.Month != "05" {
+		t.Errorf("card month %q, want the leading zero put back", main.Card.Month)
+	}
+	if result.Profiles[1].Name != "Ann Other" {
+		t.Errorf("unnamed profile called %q, want its first and last name", result.Profiles[1].Name)
+	}
+
+	// Rows are numbered as a spreadsheet shows them, with the header as row 1
+	if len(result.RowErrors) != 1 || result.RowErrors[0].Row != 3 || result.RowErrors[0].Errors[0].Field != "Card.Number" {
+		t.Errorf("row errors = %+v, want the bad card on row 3", result.RowErrors)
+	}
+	if len(result.Duplicates) != 2 {
+		t.Fatalf("duplicates = %+v, want 2", result.Duplicates)
+	}
+	if d := result.Duplicates[0]; d.Row != 4 || d.Reason != "Name already used" {
+		t.Errorf("duplicate name = %+v, want row 4", d)
+	}
+	// Same email, card and postcode, ignoring case and spacing
+	if d := result.Duplicates[1]; d.Row != 5 || d.Name != "Copy" {
+		t.Errorf("duplicate person = %+v, want row 5", d)
+	}
+}
+
+func TestParseProfilesExistingDuplicates(t *testing.T) {
+	existing := validProfile()
+	existing.Name = "Main"
+	existing.Card = existing.Card.Masked()
+
+	mapping := SuggestMapping(strings.Split(strings.SplitN(strings.TrimPrefix(profilesCSV, "\ufeff"), "\n", 2)[0], ","))
+	result, err := ParseProfiles(strings.NewReader(profilesCSV), FormatCSV, mapping, []CheckoutProfile{existing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Main and main clash with the existing name, Copy with its masked card
+	if len(result.Profiles) != 1 || result.Profiles[0].Name != "Ann Other" {
+		t.Errorf("imported %+v, want only Ann Other", result.Profiles)
+	}
+	if len(result.Duplicates) != 3 {
+		t.Errorf("duplicates = %+v, want 3", result.Duplicates)
+	}
+}
+
+func TestParseProfilesJSON(t *testing.T) {
+	data := `[{"label":"Main","mail":"test@example.com","country":"UK","fname":"Test","lname":"Buyer",
+		"street":"1 High Street","town":"London","zip":"SW1A 1AA","telephone":"7700900123",
+		"pan":4242424242424242,"cardholder":"TEST BUYER","expmonth":12,"expyear":2099,"cvv":"123","ignored":true}]`
+
+	columns, err := ReadColumns(strings.NewReader(data), FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapping := SuggestMapping(columns)
+	if _, ok := mapping["ignored"]; ok {
+		t.Errorf("unknown key mapped: %v", mapping)
+	}
+
+	result, err := ParseProfiles(strings.NewReader(data), FormatJSON, mapping, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Profiles) != 1 {
+		t.Fatalf("imported %+v", result)
+	}
+	// A card number as a JSON number keeps every digit
+	if got := result.Profiles[0].Card; got.Number != "4242424242424242" || got.Month != "12" || got.Year != "2099" {
+		t.Errorf("card = %+v", got)
+	}
+}
+
+func TestParseProfilesErrors(t *testing.T) {
+	if _, err := ParseProfiles(strings.NewReader(""), FormatCSV, ColumnMapping{}, nil); err == nil {
+		t.Error("empty CSV accepted")
+	}
+	if _, err := ParseProfiles(strings.NewReader(`{"name":"x"}`), FormatJSON, ColumnMapping{}, nil); err == nil {
+		t.Error("JSON object accepted, want an array")
+	}
+	if _, err := ParseProfiles(strings.NewReader("a\n1\n"), FormatCSV, ColumnMapping{"a": "shoe_size"}, nil); err == nil {
+		t.Error("mapping to an unknown column accepted")
+	}
+	if _, err := ParseProfiles(strings.NewReader(""), "xml", ColumnMapping{}, nil); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+func TestWriteProfilesRoundTrip(t *testing.T) {
+	profile := validProfile()
+
+	var masked bytes.Buffer
+	if err := WriteProfiles(&masked, FormatCSV, []CheckoutProfile{profile}, false); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(masked.String(), "4242 4242 4242 4242") || strings.Contains(masked.String(), ",123") {
+		t.Errorf("export without secrets has the card: %s", masked.String())
+	}
+
+	for _, format := range []ProfileFormat{FormatCSV, FormatJSON} {
+		var out bytes.Buffer
+		if err := WriteProfiles(&out, format, []CheckoutProfile{profile}, true); err != nil {
+			t.Fatal(err)
+		}
+		columns, err := ReadColumns(bytes.NewReader(out.Bytes()), format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := ParseProfiles(bytes.NewReader(out.Bytes()), format, SuggestMapping(columns), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Profiles) != 1 || result.Profiles[0] != profile {
+			t.Errorf("%s round trip = %+v, want %+v", format, result, profile)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package data_handling
+
+import "fmt"
+
+// ProfileSource looks profiles up by name, so saved tasks only need to hold a reference
+type ProfileSource interface {
+	Profile(name string) (CheckoutProfile, error)
+}
+
+// StaticProfiles is a ProfileSource over a fixed set of profiles keyed by name
+type StaticProfiles map[string]CheckoutProfile
+
+func (p StaticProfiles) Profile(name string) (CheckoutProfile, error) {
+	profile, ok := p[name]
+	if !ok {
+		return CheckoutProfile{}, fmt.Errorf("Unknown profile %q", name)
+	}
+	return profile, nil
+}
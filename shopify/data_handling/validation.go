@@ -0,0 +1,286 @@
+package data_handling
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldError is a single problem with one field of Options or a CheckoutProfile
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ValidationErrors collects every FieldError found in one pass
+type ValidationErrors []FieldError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return fmt.Sprintf("%d validation error(s): %s", len(errs), strings.Join(msgs, "; "))
+}
+
+func (errs *ValidationErrors) add(field string, format string, args ...interface{}) {
+	*errs = append(*errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// errOrNil avoids returning a typed nil inside a non-nil error interface
+func (errs ValidationErrors) errOrNil() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+var (
+	digitsRegex = regexp.MustCompile(`^\d+$`)
+	// Loose on purpose, net/mail does the real parsing
+	emailDomainRegex = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+	// Keyed by lower case country name and ISO code. Countries not listed only need a non-empty postcode.
+	postcodeRegexes = map[string]*regexp.Regexp{
+		"united kingdom": regexp.MustCompile(`^(?i)(GIR ?0AA|[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2})$`),
+		"united states":  regexp.MustCompile(`^\d{5}(-\d{4})?$`),
+		"canada":         regexp.MustCompile(`^(?i)[ABCEGHJ-NPRSTVXY]\d[ABCEGHJ-NPRSTV-Z] ?\d[ABCEGHJ-NPRSTV-Z]\d$`),
+		"ireland":        regexp.MustCompile(`^(?i)([AC-FHKNPRTV-Y]\d{2}|D6W) ?[0-9AC-FHKNPRTV-Y]{4}$`),
+		"germany":        regexp.MustCompile(`^\d{5}$`),
+		"france":         regexp.MustCompile(`^\d{5}$`),
+		"italy":          regexp.MustCompile(`^\d{5}$`),
+		"spain":          regexp.MustCompile(`^\d{5}$`),
+		"netherlands":    regexp.MustCompile(`^(?i)\d{4} ?[A-Z]{2}$`),
+		"belgium":        regexp.MustCompile(`^\d{4}$`),
+		"poland":         regexp.MustCompile(`^\d{2}-\d{3}$`),
+		"sweden":         regexp.MustCompile(`^\d{3} ?\d{2}$`),
+		"australia":      regexp.MustCompile(`^\d{4}$`),
+	}
+	countryAliases = map[string]string{
+		"uk":  "united kingdom",
+		"gb":  "united kingdom",
+		"us":  "united states",
+		"usa": "united states",
+		"ca":  "canada",
+		"ie":  "ireland",
+		"de":  "germany",
+		"fr":  "france",
+		"it":  "italy",
+		"es":  "spain",
+		"nl":  "netherlands",
+		"be":  "belgium",
+		"pl":  "poland",
+		"se":  "sweden",
+		"au":  "australia",
+	}
+)
+
+// Connections opened before a scheduled start are closed by most servers if left idle much longer
+const MaxPrewarmLead = 30 * time.Second
+
+// Validate reports every problem with the task options, including the profile
+func (o Options) Validate() error {
+	var errs ValidationErrors
+
+	if strings.TrimSpace(o.URL) == "" {
+		errs.add("URL", "is required")
+	}
+	if o.VariantID != "" && !digitsRegex.MatchString(o.VariantID) {
+		errs.add("VariantID", "must be numeric")
+	}
+	if o.VariantID == "" && strings.TrimSpace(o.Size) == "" && !strings.Contains(o.URL, "variant=") {
+		errs.add("Size", "is required when no variant is given")
+	}
+
+	if o.PrewarmLead > MaxPrewarmLead {
+		errs.add("PrewarmLead", "must be at most %s, servers close idle connections", MaxPrewarmLead)
+	}
+
+	if o.MaxAttempts < 0 {
+		errs.add("MaxAttempts", "must not be negative")
+	}
+
+	if o.BaseURL != "" {
+		if u, err := url.Parse(o.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add("BaseURL", "must be an absolute http or https URL")
+		}
+	}
+
+	if o.UseProxy {
+		if o.Proxy.Host == "" {
+			errs.add("Proxy.Host", "is required when using a proxy")
+		}
+		if port, err := strconv.Atoi(o.Proxy.Port); err != nil || port < 1 || port > 65535 {
+			errs.add("Proxy.Port", "must be between 1 and 65535")
+		}
+		switch o.Proxy.Protocol {
+		case "http", "https", "socks5":
+		default:
+			errs.add("Proxy.Protocol", "must be http, https or socks5")
+		}
+	}
+
+	// A named profile is looked up when the task is created, and was checked when it was saved
+	if o.ProfileName == "" || o.Profile != (CheckoutProfile{}) {
+		for _, e := range o.Profile.validate(time.Now()) {
+			errs.add("Profile."+e.Field, "%s", e.Message)
+		}
+	}
+
+	return errs.errOrNil()
+}
+
+// Validate reports every problem with the profile's contact, address and card details
+func (p CheckoutProfile) Validate() error {
+	return p.validate(time.Now()).errOrNil()
+}
+
+func (p CheckoutProfile) validate(now time.Time) ValidationErrors {
+	var errs ValidationErrors
+
+	if p.Email == "" {
+		errs.add("Email", "is required")
+	} else if addr, err := mail.ParseAddress(p.Email); err != nil || addr.Address != p.Email || !emailDomainRegex.MatchString(p.Email) {
+		errs.add("Email", "is not a valid email address")
+	}
+
+	required := []struct {
+		field string
+		value string
+	}{
+		{"Fname", p.Fname},
+		{"Lname", p.Lname},
+		{"Address1", p.Address1},
+		{"City", p.City},
+		{"Country", p.Country},
+	}
+	for _, r := range required {
+		if strings.TrimSpace(r.value) == "" {
+			errs.add(r.field, "is required")
+		}
+	}
+
+	if phone := stripSeparators(p.Phone); phone == "" {
+		errs.add("Phone", "is required")
+	} else if !digitsRegex.MatchString(strings.TrimPrefix(phone, "+")) || len(phone) < 7 || len(phone) > 15 {
+		errs.add("Phone", "must be 7 to 15 digits")
+	}
+
+	if msg := validatePostcode(p.Country, p.Zipcode); msg != "" {
+		errs.add("Zipcode", "%s", msg)
+	}
+
+	for _, e := range p.Card.validate(now) {
+		errs.add("Card."+e.Field, "%s", e.Message)
+	}
+
+	return errs
+}
+
+// Validate reports every problem with the card number, expiry and CVV
+func (c CardDetails) Validate() error {
+	return c.validate(time.Now()).errOrNil()
+}
+
+func (c CardDetails) validate(now time.Time) ValidationErrors {
+	var errs ValidationErrors
+
+	number := stripSeparators(c.Number)
+	switch {
+	case number == "":
+		errs.add("Number", "is required")
+	case !digitsRegex.MatchString(number) || len(number) < 12 || len(number) > 19:
+		errs.add("Number", "must be 12 to 19 digits")
+	case !luhnValid(number):
+		errs.add("Number", "failed the Luhn check")
+	}
+
+	if strings.TrimSpace(c.Name) == "" {
+		errs.add("Name", "is required")
+	}
+
+	month, monthErr := strconv.Atoi(c.Month)
+	if monthErr != nil || month < 1 || month > 12 {
+		errs.add("Month", "must be between 01 and 12")
+	}
+	year, yearErr := strconv.Atoi(c.Year)
+	if yearErr == nil && len(c.Year) == 2 {
+		year += 2000
+	}
+	if yearErr != nil || (len(c.Year) != 2 && len(c.Year) != 4) {
+		errs.add("Year", "must be a 2 or 4 digit year")
+	} else if monthErr == nil && month >= 1 && month <= 12 {
+		// Cards are valid until the end of their expiry month
+		expiry := time.Date(year, time.Month(month)+1, 1, 0, 0, 0, 0, time.UTC)
+		if !now.Before(expiry) {
+			errs.add("Year", "card expired %02d/%d", month, year)
+		}
+	}
+
+	cvvLen := 3
+	if strings.HasPrefix(number, "34") || strings.HasPrefix(number, "37") {
+		// American Express
+		cvvLen = 4
+	}
+	if !digitsRegex.MatchString(c.VerificationValue) || len(c.VerificationValue) != cvvLen {
+		errs.add("VerificationValue", "must be %d digits", cvvLen)
+	}
+
+	return errs
+}
+
+// validatePostcode returns a message describing the problem, or "" when the postcode is fine
+func validatePostcode(country string, postcode string) string {
+	postcode = strings.TrimSpace(postcode)
+	key := strings.ToLower(strings.TrimSpace(country))
+	if alias, ok := countryAliases[key]; ok {
+		key = alias
+	}
+
+	if postcode == "" {
+		// Most of Ireland gets by without one
+		if key == "ireland" {
+			return ""
+		}
+		return "is required"
+	}
+
+	r, ok := postcodeRegexes[key]
+	if !ok {
+		return ""
+	}
+	if !r.MatchString(postcode) {
+		return fmt.Sprintf("is not a valid postcode for %s", country)
+	}
+	return ""
+}
+
+// luhnValid expects a string of digits only
+func luhnValid(number string) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+func stripSeparators(s string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(s))
+}
@@ -0,0 +1,198 @@
+package data_handling
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2024, time.June, 15, 12, 0, 0, 0, time.UTC)
+
+func validProfile() CheckoutProfile {
+	return CheckoutProfile{
+		Name:     "Test",
+		Email:    "test@example.com",
+		Country:  "United Kingdom",
+		Fname:    "Test",
+		Lname:    "Buyer",
+		Address1: "1 High Street",
+		City:     "London",
+		Zipcode:  "SW1A 1AA",
+		Phone:    "7700900123",
+		Card: CardDetails{
+			Number:            "4242 4242 4242 4242",
+			Name:              "TEST BUYER",
+			Month:             "12",
+			Year:              "2099",
+			VerificationValue: "123",
+		},
+	}
+}
+
+// fields lists the fields errs complains about
+func fields(errs ValidationErrors) map[string]bool {
+	got := map[string]bool{}
+	for _, e := range errs {
+		got[e.Field] = true
+	}
+	return got
+}
+
+func TestLuhnValid(t *testing.T) {
+	tests := []struct {
+		number string
+		want   bool
+	}{
+		{"4242424242424242", true},
+		{"4111111111111111", true},
+		{"378282246310005", true},
+		{"5555555555554444", true},
+		{"4242424242424241", false},
+		{"1234567812345678", false},
+		{"40000000000002", true},
+		{"40000000000001", false},
+	}
+	for _, tt := range tests {
+		if got := luhnValid(tt.number); got != tt.want {
+			t.Errorf("luhnValid(%q) = %v, want %v", tt.number, got, tt.want)
+		}
+	}
+}
+
+func TestCardValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*CardDetails)
+		want   []string // Fields with errors, none for a valid card
+	}{
+		{"valid", func(c *CardDetails) {}, nil},
+		{"dashes and spaces", func(c *CardDetails) { c.Number = "4242-4242 4242-4242" }, nil},
+		{"missing number", func(c *CardDetails) { c.Number = "" }, []string{"Number"}},
+		{"letters", func(c *CardDetails) { c.Number = "4242 4242 4242 abcd" }, []string{"Number"}},
+		{"too short", func(c *CardDetails) { c.Number = "42424242424" }, []string{"Number"}},
+		{"fails Luhn", func(c *CardDetails) { c.Number = "4242424242424241" }, []string{"Number"}},
+		{"missing name", func(c *CardDetails) { c.Name = " " }, []string{"Name"}},
+		{"month 0", func(c *CardDetails) { c.Month = "0" }, []string{"Month"}},
+		{"month 13", func(c *CardDetails) { c.Month = "13" }, []string{"Month"}},
+		{"3 digit year", func(c *CardDetails) { c.Year = "209" }, []string{"Year"}},
+		{"2 digit year", func(c *CardDetails) { c.Year = "30" }, nil},
+		{"expires this month", func(c *CardDetails) { c.Month, c.Year = "06", "2024" }, nil},
+		{"expired last month", func(c *CardDetails) { c.Month, c.Year = "05", "2024" }, []string{"Year"}},
+		{"expired 2 digit year", func(c *CardDetails) { c.Month, c.Year = "12", "23" }, []string{"Year"}},
+		{"short CVV", func(c *CardDetails) { c.VerificationValue = "12" }, []string{"VerificationValue"}},
+		{"Amex needs 4 digit CVV", func(c *CardDetails) { c.Number = "378282246310005" }, []string{"VerificationValue"}},
+		{"Amex with 4 digit CVV", func(c *CardDetails) { c.Number, c.VerificationValue = "378282246310005", "1234" }, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			card := validProfile().Card
+			tt.change(&card)
+			got := fields(card.validate(testNow))
+			if len(got) != len(tt.want) {
+				t.Fatalf("errors on %v, want %v", got, tt.want)
+			}
+			for _, field := range tt.want {
+				if !got[field] {
+					t.Errorf("no error on %s, got %v", field, got)
+				}
+			}
+		})
+	}
+}
+
+func TestValidatePostcode(t *testing.T) {
+	tests := []struct {
+		country  string
+		postcode string
+		valid    bool
+	}{
+		{"United Kingdom", "SW1A 1AA", true},
+		{"uk", "sw1a1aa", true},
+		{"GB", "GIR 0AA", true},
+		{"United Kingdom", "12345", false},
+		{"US", "90210", true},
+		{"usa", "90210-1234", true},
+		{"United States", "9021", false},
+		{"Canada", "K1A 0B1", true},
+		{"Canada", "D1A 0B1", false},
+		{"Ireland", "", true},
+		{"Ireland", "D6W 1234", true},
+		{"Netherlands", "1234 AB", true},
+		{"Poland", "00-950", true},
+		{"Poland", "00950", false},
+		{"Germany", "", false},
+		{"Narnia", "anything", true},
+		{"Narnia", "", false},
+	}
+	for _, tt := range tests {
+		msg := validatePostcode(tt.country, tt.postcode)
+		if (msg == "") != tt.valid {
+			t.Errorf("validatePostcode(%q, %q) = %q, want valid %v", tt.country, tt.postcode, msg, tt.valid)
+		}
+	}
+}
+
+func TestProfileValidate(t *testing.T) {
+	if errs := validProfile().validate(testNow); len(errs) != 0 {
+		t.Fatalf("valid profile has errors: %v", errs)
+	}
+
+	p := validProfile()
+	p.Email = "not an email"
+	p.Fname = ""
+	p.Phone = "12ab"
+	p.Zipcode = "12345"
+	p.Card.Number = "4242424242424241"
+	got := fields(p.validate(testNow))
+	for _, field := range []string{"Email", "Fname", "Phone", "Zipcode", "Card.Number"} {
+		if !got[field] {
+			t.Errorf("no error on %s, got %v", field, got)
+		}
+	}
+	if len(got) != 5 {
+		t.Errorf("errors on %v, want only the 5 broken fields", got)
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	valid := Options{URL: "https://www.example.com/products/dunk-low", Size: "UK 9", Profile: validProfile()}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("valid options: %v", err)
+	}
+	saved := Options{URL: valid.URL, Size: valid.Size, ProfileName: "Main"}
+	if err := saved.Validate(); err != nil {
+		t.Errorf("options with a saved profile: %v", err)
+	}
+	// Once it's looked up the profile itself is checked
+	saved.Profile = validProfile()
+	saved.Profile.Email = "nope"
+	if err := saved.Validate(); err == nil {
+		t.Error("resolved profile with a bad email accepted")
+	}
+
+	o := valid
+	o.URL = ""
+	o.Size = ""
+	o.VariantID = "abc"
+	o.BaseURL = "localhost:8443"
+	o.UseProxy = true
+	o.Proxy = ProxyDefiniton{Port: "70000", Protocol: "ftp"}
+	o.PrewarmLead = time.Minute
+	o.MaxAttempts = -1
+	err := o.Validate()
+
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Validate() = %v, want ValidationErrors", err)
+	}
+	got := fields(errs)
+	for _, field := range []string{"URL", "VariantID", "BaseURL", "Proxy.Host", "Proxy.Port", "Proxy.Protocol", "PrewarmLead", "MaxAttempts"} {
+		if !got[field] {
+			t.Errorf("no error on %s, got %v", field, got)
+		}
+	}
+	// Size isn't needed once a variant is given, even an invalid one
+	if got["Size"] {
+		t.Errorf("unexpected Size error with a variant ID")
+	}
+}
@@ -0,0 +1,575 @@
+package data_handling
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+var (
+	ErrVaultLocked     = errors.New("Profile vault is locked")
+	ErrVaultExists     = errors.New("Profile vault already exists")
+	ErrVaultMissing    = errors.New("Profile vault has not been created")
+	ErrWrongPassphrase = errors.New("Wrong vault passphrase")
+	ErrProfileExists   = errors.New("A profile with that name already exists")
+	ErrProfileNotFound = errors.New("Profile not found")
+)
+
+const (
+	vaultFileVersion = 1
+	vaultKeyLength   = 32
+	vaultSaltLength  = 16
+)
+
+// Argon2id cost, stored in the file so it can be raised later without breaking old vaults
+type kdfParams struct {
+	Name    string `json:"name"`
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"` // KiB
+	Threads uint8  `json:"threads"`
+}
+
+var defaultKDF = kdfParams{Name: "argon2id", Time: 3, Memory: 64 * 1024, Threads: 4}
+
+type vaultFile struct {
+	Version    int       `json:"version"`
+	KDF        kdfParams `json:"kdf"`
+	Nonce      []byte    `json:"nonce"`
+	Ciphertext []byte    `json:"ciphertext"` // AES-256-GCM sealed JSON of []vaultEntry
+}
+
+// vaultEntry keeps the card sealed separately, so unlocking the vault to list
+// profiles doesn't put card numbers in memory
+type vaultEntry struct {
+	Profile    CheckoutProfile `json:"profile"` // Card is always empty here
+	SealedCard []byte          `json:"card"`
+}
+
+// Vault is an encrypted file of checkout profiles. The key is derived from a
+// passphrase and dropped again after IdleTimeout without use.
+type Vault struct {
+	mu          sync.Mutex
+	path        string
+	idleTimeout time.Duration
+	kdf         kdfParams
+	key         []byte // Nil while locked
+	entries     map[string]vaultEntry
+	idleTimer   *time.Timer
+}
+
+// Constructor. Nothing is read until Unlock.
+func NewVault(path string, idleTimeout time.Duration) *Vault {
+	return &Vault{path: path, idleTimeout: idleTimeout}
+}
+
+// DefaultVault keeps the vault in the app data directory
+func DefaultVault(idleTimeout time.Duration) (*Vault, error) {
+	path, err := AppDataPath("profiles.vault")
+	if err != nil {
+		return nil, err
+	}
+	return NewVault(path, idleTimeout), nil
+}
+
+func (v *Vault) Exists() bool {
+	_, err := os.Stat(v.path)
+	return err == nil
+}
+
+// Create writes a new empty vault and leaves it unlocked
+func (v *Vault) Create(passphrase string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.Exists() {
+		return ErrVaultExists
+	}
+	if len(passphrase) < 8 {
+		return errors.New("Vault passphrase must be at least 8 characters")
+	}
+
+	kdf := defaultKDF
+	kdf.Salt = make([]byte, vaultSaltLength)
+	if _, err := rand.Read(kdf.Salt); err != nil {
+		return err
+	}
+
+	v.kdf = kdf
+	v.key = kdf.derive(passphrase)
+	v.entries = map[string]vaultEntry{}
+	v.touchLocked()
+	return v.saveLocked()
+}
+
+// Unlock derives the key from the passphrase and decrypts the profile list
+func (v *Vault) Unlock(passphrase string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	data, err := os.ReadFile(v.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrVaultMissing
+	}
+	if err != nil {
+		return err
+	}
+
+	var file vaultFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("Could not read vault: %w", err)
+	}
+	if file.Version > vaultFileVersion {
+		return fmt.Errorf("Vault was written by a newer version (file version %d)", file.Version)
+	}
+	if file.KDF.Name != "argon2id" {
+		return fmt.Errorf("Unsupported vault key derivation %q", file.KDF.Name)
+	}
+
+	key := file.KDF.derive(passphrase)
+	plain, err := open(key, file.Nonce, file.Ciphertext)
+	if err != nil {
+		wipe(key)
+		return ErrWrongPassphrase
+	}
+	defer wipe(plain)
+
+	var list []vaultEntry
+	if err := json.Unmarshal(plain, &list); err != nil {
+		wipe(key)
+		return fmt.Errorf("Could not read vault: %w", err)
+	}
+
+	v.lockLocked()
+	v.kdf = file.KDF
+	v.key = key
+	v.entries = map[string]vaultEntry{}
+	for _, entry := range list {
+		v.entries[entry.Profile.Name] = entry
+	}
+	v.touchLocked()
+	return nil
+}
+
+// Lock forgets the key and every profile until the next Unlock
+func (v *Vault) Lock() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.lockLocked()
+}
+
+func (v *Vault) lockLocked() {
+	wipe(v.key)
+	v.key = nil
+	v.entries = nil
+	if v.idleTimer != nil {
+		v.idleTimer.Stop()
+		v.idleTimer = nil
+	}
+}
+
+func (v *Vault) Locked() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.key == nil
+}
+
+// touchLocked restarts the idle countdown
+func (v *Vault) touchLocked() {
+	if v.idleTimeout <= 0 {
+		return
+	}
+	if v.idleTimer != nil {
+		v.idleTimer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(v.idleTimeout, func() {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		// Stop can lose the race with a timer that's already firing, which mustn't
+		// lock a vault that has been used or unlocked again since
+		if v.idleTimer == timer {
+			v.lockLocked()
+		}
+	})
+	v.idleTimer = timer
+}
+
+func (v *Vault) unlockedLocked() error {
+	if v.key == nil {
+		return ErrVaultLocked
+	}
+	v.touchLocked()
+	return nil
+}
+
+// List returns every profile with its card number masked and CVV removed
+func (v *Vault) List() ([]CheckoutProfile, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.unlockedLocked(); err != nil {
+		return nil, err
+	}
+
+	profiles := make([]CheckoutProfile, 0, len(v.entries))
+	for name := range v.entries {
+		profile, err := v.maskedLocked(name)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Name < profiles[j].Name
+	})
+	return profiles, nil
+}
+
+// Get returns one profile with its card number masked and CVV removed
+func (v *Vault) Get(name string) (CheckoutProfile, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.unlockedLocked(); err != nil {
+		return CheckoutProfile{}, err
+	}
+	return v.maskedLocked(name)
+}
+
+func (v *Vault) maskedLocked(name string) (CheckoutProfile, error) {
+	entry, ok := v.entries[name]
+	if !ok {
+		return CheckoutProfile{}, ErrProfileNotFound
+	}
+	card, err := v.openCardLocked(entry)
+	if err != nil {
+		return CheckoutProfile{}, err
+	}
+	profile := entry.Profile
+	profile.Card = card.Masked()
+	return profile, nil
+}
+
+// Profile returns the profile with its full card details. Only call this when a
+// task is about to check out; it implements ProfileSource for the task manager.
+func (v *Vault) Profile(name string) (CheckoutProfile, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.unlockedLocked(); err != nil {
+		return CheckoutProfile{}, err
+	}
+	entry, ok := v.entries[name]
+	if !ok {
+		return CheckoutProfile{}, fmt.Errorf("%w: %q", ErrProfileNotFound, name)
+	}
+	card, err := v.openCardLocked(entry)
+	if err != nil {
+		return CheckoutProfile{}, err
+	}
+	profile := entry.Profile
+	profile.Card = card
+	return profile, nil
+}
+
+// Add stores a new profile. The profile must be valid and its name unused.
+func (v *Vault) Add(profile CheckoutProfile) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.unlockedLocked(); err != nil {
+		return err
+	}
+	if _, ok := v.entries[profile.Name]; ok {
+		return ErrProfileExists
+	}
+	return v.putLocked(profile)
+}
+
+// Update replaces the profile called name, which may rename it. An empty or
+// masked card number keeps the stored card details.
+func (v *Vault) Update(name string, profile CheckoutProfile) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.unlockedLocked(); err != nil {
+		return err
+	}
+	existing, ok := v.entries[name]
+	if !ok {
+		return ErrProfileNotFound
+	}
+	if profile.Name != name {
+		if _, taken := v.entries[profile.Name]; taken {
+			return ErrProfileExists
+		}
+	}
+
+	if profile.Card.Number == "" || strings.Contains(profile.Card.Number, "*") {
+		card, err := v.openCardLocked(existing)
+		if err != nil {
+			return err
+		}
+		profile.Card = card
+	}
+
+	delete(v.entries, name)
+	if err := v.putLocked(profile); err != nil {
+		v.entries[name] = existing
+		return err
+	}
+	return nil
+}
+
+// Delete removes a profile
+func (v *Vault) Delete(name string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.unlockedLocked(); err != nil {
+		return err
+	}
+	existing, ok := v.entries[name]
+	if !ok {
+		return ErrProfileNotFound
+	}
+	delete(v.entries, name)
+	if err := v.saveLocked(); err != nil {
+		v.entries[name] = existing
+		return err
+	}
+	return nil
+}
+
+// ImportProfiles adds every valid, non-duplicate profile from the file. The vault
+// must be unlocked and the passphrase entered again.
+func (v *Vault) ImportProfiles(passphrase string, r io.Reader, format ProfileFormat, mapping ColumnMapping) (ImportResult, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.confirmLocked(passphrase); err != nil {
+		return ImportResult{}, err
+	}
+
+	existing := make([]CheckoutProfile, 0, len(v.entries))
+	for name := range v.entries {
+		profile, err := v.maskedLocked(name)
+		if err != nil {
+			return ImportResult{}, err
+		}
+		existing = append(existing, profile)
+	}
+
+	result, err := ParseProfiles(r, format, mapping, existing)
+	if err != nil {
+		return result, err
+	}
+
+	for _, profile := range result.Profiles {
+		entry, err := v.sealLocked(profile)
+		if err != nil {
+			return result, err
+		}
+		v.entries[profile.Name] = entry
+	}
+	if err := v.saveLocked(); err != nil {
+		return result, err
+	}
+
+	// The caller only needs to know what was imported, not the card numbers
+	for i := range result.Profiles {
+		result.Profiles[i].Card = result.Profiles[i].Card.Masked()
+	}
+	return result, nil
+}
+
+// ExportProfiles writes every profile. Card numbers are masked unless includeSecrets
+// is set. The vault must be unlocked and the passphrase entered again.
+func (v *Vault) ExportProfiles(passphrase string, w io.Writer, format ProfileFormat, includeSecrets bool) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.confirmLocked(passphrase); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(v.entries))
+	for name := range v.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	profiles := make([]CheckoutProfile, len(names))
+	for i, name := range names {
+		entry := v.entries[name]
+		card, err := v.openCardLocked(entry)
+		if err != nil {
+			return err
+		}
+		profiles[i] = entry.Profile
+		profiles[i].Card = card
+	}
+	return WriteProfiles(w, format, profiles, includeSecrets)
+}
+
+// confirmLocked checks the passphrase against the unlocked key, for actions
+// that move profiles in or out of the vault
+func (v *Vault) confirmLocked(passphrase string) error {
+	if err := v.unlockedLocked(); err != nil {
+		return err
+	}
+	key := v.kdf.derive(passphrase)
+	defer wipe(key)
+	if subtle.ConstantTimeCompare(key, v.key) != 1 {
+		return ErrWrongPassphrase
+	}
+	return nil
+}
+
+func (v *Vault) putLocked(profile CheckoutProfile) error {
+	if strings.TrimSpace(profile.Name) == "" {
+		return errors.New("Profile name is required")
+	}
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+
+	entry, err := v.sealLocked(profile)
+	if err != nil {
+		return err
+	}
+	v.entries[profile.Name] = entry
+	return v.saveLocked()
+}
+
+// sealLocked encrypts the profile's card into a vault entry
+func (v *Vault) sealLocked(profile CheckoutProfile) (vaultEntry, error) {
+	cardJSON, err := json.Marshal(profile.Card)
+	if err != nil {
+		return vaultEntry{}, err
+	}
+	defer wipe(cardJSON)
+
+	nonce, sealed, err := seal(v.key, cardJSON)
+	if err != nil {
+		return vaultEntry{}, err
+	}
+
+	profile.Card = CardDetails{}
+	return vaultEntry{Profile: profile, SealedCard: append(nonce, sealed...)}, nil
+}
+
+func (v *Vault) openCardLocked(entry vaultEntry) (CardDetails, error) {
+	nonceSize := 12
+	if len(entry.SealedCard) < nonceSize {
+		return CardDetails{}, errors.New("Corrupt card entry in vault")
+	}
+	plain, err := open(v.key, entry.SealedCard[:nonceSize], entry.SealedCard[nonceSize:])
+	if err != nil {
+		return CardDetails{}, errors.New("Corrupt card entry in vault")
+	}
+	defer wipe(plain)
+
+	var card CardDetails
+	if err := json.Unmarshal(plain, &card); err != nil {
+		return CardDetails{}, err
+	}
+	return card, nil
+}
+
+// saveLocked seals every entry and replaces the vault file via a temporary file
+func (v *Vault) saveLocked() error {
+	list := make([]vaultEntry, 0, len(v.entries))
+	for _, entry := range v.entries {
+		list = append(list, entry)
+	}
+	plain, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	defer wipe(plain)
+
+	nonce, ciphertext, err := seal(v.key, plain)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(vaultFile{
+		Version:    vaultFileVersion,
+		KDF:        v.kdf,
+		Nonce:      nonce,
+		Ciphertext: ciphertext,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(v.path), filepath.Base(v.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), v.path)
+}
+
+func (k kdfParams) derive(passphrase string) []byte {
+	return argon2.IDKey([]byte(passphrase), k.Salt, k.Time, k.Memory, k.Threads, vaultKeyLength)
+}
+
+func seal(key []byte, plain []byte) (nonce []byte, ciphertext []byte, err error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, gcm.Seal(nil, nonce, plain, nil), nil
+}
+
+func open(key []byte, nonce []byte, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("Invalid nonce")
+	}
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wipe zeroes decrypted bytes once they're no longer needed
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
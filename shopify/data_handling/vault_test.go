@@ -0,0 +1,170 @@
+package data_handling
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testPassphrase = "correct horse battery"
+
+func init() {
+	// The cost is stored in each vault, so tests can use a cheap one
+	defaultKDF.Time = 1
+	defaultKDF.Memory = 8 * 1024
+}
+
+func newTestVault(t *testing.T, idleTimeout time.Duration) *Vault {
+	t.Helper()
+	v := NewVault(filepath.Join(t.TempDir(), "profiles.vault"), idleTimeout)
+	if err := v.Create(testPassphrase); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestVaultSealAndOpen(t *testing.T) {
+	v := newTestVault(t, 0)
+	profile := validProfile()
+	if err := v.Add(profile); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(v.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"4242", profile.Email, profile.Address1} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Errorf("vault file contains %q in the clear", secret)
+		}
+	}
+
+	// A new Vault on the same file only has what was saved
+	reopened := NewVault(v.path, 0)
+	if err := reopened.Unlock(testPassphrase); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	got, err := reopened.Profile(profile.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != profile {
+		t.Errorf("Profile() = %+v, want %+v", got, profile)
+	}
+
+	masked, err := reopened.Get(profile.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if masked.Card.Number != "**** **** **** 4242" || masked.Card.VerificationValue != "" {
+		t.Errorf("Get() card = %+v, want it masked", masked.Card)
+	}
+}
+
+func TestVaultWrongPassphrase(t *testing.T) {
+	v := newTestVault(t, 0)
+	if err := v.Add(validProfile()); err != nil {
+		t.Fatal(err)
+	}
+	v.Lock()
+
+	if err := v.Unlock("wrong passphrase"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("Unlock with the wrong passphrase = %v, want ErrWrongPassphrase", err)
+	}
+	if !v.Locked() {
+		t.Error("vault unlocked with the wrong passphrase")
+	}
+	if _, err := v.List(); !errors.Is(err, ErrVaultLocked) {
+		t.Errorf("List() on a locked vault = %v, want ErrVaultLocked", err)
+	}
+	if _, err := v.Profile("Test"); !errors.Is(err, ErrVaultLocked) {
+		t.Errorf("Profile() on a locked vault = %v, want ErrVaultLocked", err)
+	}
+
+	if err := v.Unlock(testPassphrase); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	var out bytes.Buffer
+	if err := v.ExportProfiles("wrong passphrase", &out, FormatJSON, true); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("ExportProfiles with the wrong passphrase = %v, want ErrWrongPassphrase", err)
+	}
+}
+
+func TestVaultMissingAndExisting(t *testing.T) {
+	v := NewVault(filepath.Join(t.TempDir(), "profiles.vault"), 0)
+	if err := v.Unlock(testPassphrase); !errors.Is(err, ErrVaultMissing) {
+		t.Errorf("Unlock before Create = %v, want ErrVaultMissing", err)
+	}
+	if err := v.Create("short"); err == nil {
+		t.Error("Create accepted a short passphrase")
+	}
+	if err := v.Create(testPassphrase); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Create(testPassphrase); !errors.Is(err, ErrVaultExists) {
+		t.Errorf("second Create = %v, want ErrVaultExists", err)
+	}
+}
+
+func TestVaultUpdateKeepsMaskedCard(t *testing.T) {
+	v := newTestVault(t, 0)
+	profile := validProfile()
+	if err := v.Add(profile); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Add(profile); !errors.Is(err, ErrProfileExists) {
+		t.Errorf("adding a duplicate = %v, want ErrProfileExists", err)
+	}
+
+	masked, err := v.Get(profile.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	masked.Name = "Renamed"
+	masked.City = "Leeds"
+	if err := v.Update(profile.Name, masked); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := v.Profile("Renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.City != "Leeds" || got.Card != profile.Card {
+		t.Errorf("updated profile = %+v, want the city changed and the card kept", got)
+	}
+	if _, err := v.Profile(profile.Name); !errors.Is(err, ErrProfileNotFound) {
+		t.Errorf("old name still found after rename: %v", err)
+	}
+}
+
+func TestVaultIdleLock(t *testing.T) {
+	const idle = 50 * time.Millisecond
+	v := newTestVault(t, idle)
+
+	// Each use restarts the countdown, so a vault in use never locks
+	for i := 0; i < 8; i++ {
+		time.Sleep(idle / 2)
+		if _, err := v.List(); err != nil {
+			t.Fatalf("vault locked while in use: %v", err)
+		}
+	}
+
+	time.Sleep(4 * idle)
+	if !v.Locked() {
+		t.Error("vault still unlocked after the idle timeout")
+	}
+
+	// Unlocking again starts a fresh countdown that earlier timers can't cut short
+	if err := v.Unlock(testPassphrase); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(idle / 2)
+	if v.Locked() {
+		t.Error("vault locked straight after unlocking")
+	}
+}
@@ -0,0 +1,52 @@
+package shopify_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"alin/packages/session"
+	"alin/packages/shopify/data_handling"
+	"alin/packages/shopify/shopifytest"
+)
+
+// Checkout steps run against a fake Doer whose responses have no Request, as
+// hand built ones usually don't
+func TestFakeDoer(t *testing.T) {
+	srv := shopifytest.NewServer(shopifytest.HappyPath)
+	defer srv.Close()
+	inst, err := srv.NewInstance(data_handling.Options{Profile: shopifytest.Profile(), VariantID: "40000000000002", MaxAttempts: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	inst.Session.SetDoer(session.DoerFunc(func(req *http.Request) (*http.Response, error) {
+		paths = append(paths, req.Method+" "+req.URL.Path)
+		respond := func(status int, body string) (*http.Response, error) {
+			return &http.Response{StatusCode: status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body))}, nil
+		}
+		switch req.URL.Path {
+		case "/cart/add.js":
+			return respond(http.StatusOK, `{"id":40000000000002,"quantity":1,"title":"Dunk Low Pro","price":4995}`)
+		case "/checkout":
+			// Without the redirect to a checkout, the checkout step lands on /checkout itself
+			return respond(http.StatusOK, "")
+		}
+		t.Errorf("unexpected %s %s", req.Method, req.URL)
+		return respond(http.StatusNotFound, "")
+	}))
+
+	err = inst.Run(context.Background())
+	if err == nil || err.Error() != "Redirected back to cart" {
+		t.Fatalf("Run = %v, want the checkout step to see it wasn't sent to a checkout", err)
+	}
+	if inst.Cart.Title != "Dunk Low Pro" {
+		t.Errorf("cart %+v, want the fake's", inst.Cart)
+	}
+	if strings.Join(paths, ",") != "POST /cart/add.js,POST /checkout" || srv.Hits("/checkout") != 0 {
+		t.Errorf("sent %v, want the cart and checkout steps to reach only the fake", paths)
+	}
+}
@@ -0,0 +1,52 @@
+package shopify_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"alin/packages/shopify"
+	"alin/packages/shopify/data_handling"
+	"alin/packages/shopify/shopifytest"
+)
+
+// A checkout recorded against the fake store replays offline. UK 9's variant ID,
+// 40000000000002, passes the Luhn check, so it must survive redaction.
+func TestRecordAndReplay(t *testing.T) {
+	srv := shopifytest.NewServer(shopifytest.HappyPath)
+	defer srv.Close()
+
+	options := data_handling.Options{URL: srv.ProductURL(), Profile: shopifytest.Profile(), Size: "UK 9"}
+	inst, err := srv.NewInstance(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := inst.Session.Record()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := inst.Run(ctx); err != nil {
+		t.Fatalf("recorded run: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "checkout.har")
+	if err := recorder.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	hits := srv.Hits("/products/dunk-low-pro")
+	options.ReplayHAR = path
+	replay, err := shopify.NewShopifyInstance(options, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replay.Run(ctx); err != nil {
+		t.Fatalf("replayed run: %v", err)
+	}
+	if replay.VariantID != "40000000000002" {
+		t.Errorf("replay carted variant %q, want 40000000000002", replay.VariantID)
+	}
+	if srv.Hits("/products/dunk-low-pro") != hits || len(srv.Orders()) != 1 {
+		t.Errorf("replay reached the store")
+	}
+}
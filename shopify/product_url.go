@@ -0,0 +1,99 @@
+package shopify
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	handleRegex    = regexp.MustCompile(`^[\w-]+$`)
+	variantIDRegex = regexp.MustCompile(`^\d+$`)
+)
+
+// ProductURL is a product page reference split into the parts a task needs
+type ProductURL struct {
+	Scheme    string
+	Host      string // Host including port, used to build request URLs
+	Handle    string
+	VariantID string // Taken from ?variant= when present
+}
+
+// Hostname returns the host without its port, used to look up the store
+func (p ProductURL) Hostname() string {
+	u := url.URL{Host: p.Host}
+	return u.Hostname()
+}
+
+// Path returns the product path without a leading slash, e.g. "products/some-handle"
+func (p ProductURL) Path() string {
+	return fmt.Sprintf("products/%s", p.Handle)
+}
+
+// String returns the canonical product page URL, without locale, collection or query
+func (p ProductURL) String() string {
+	return fmt.Sprintf("%s://%s/%s", p.Scheme, p.Host, p.Path())
+}
+
+// ParseProductURL accepts a full product URL (with optional port, locale prefix,
+// collection path and query string), a scheme-less URL or a bare product handle.
+// defaultDomain is only used for bare handles.
+func ParseProductURL(raw string, defaultDomain string) (ProductURL, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return ProductURL{}, errors.New("Empty product URL")
+	}
+
+	// Bare handle, e.g. "nike-sb-dunk-low-pro"
+	if handleRegex.MatchString(raw) {
+		if defaultDomain == "" {
+			return ProductURL{}, fmt.Errorf("Product handle %q given without a store domain", raw)
+		}
+		return ProductURL{Scheme: "https", Host: defaultDomain, Handle: raw}, nil
+	}
+
+	if strings.HasPrefix(raw, "//") {
+		raw = "https:" + raw
+	} else if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ProductURL{}, fmt.Errorf("Could not parse product URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ProductURL{}, fmt.Errorf("Unsupported URL scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return ProductURL{}, errors.New("Product URL has no host")
+	}
+
+	// Find the segment after "products", skipping locale prefixes such as
+	// /en-gb/ and collection paths such as /collections/footwear/
+	var handle string
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i := 0; i < len(segments)-1; i++ {
+		if segments[i] == "products" {
+			handle = segments[i+1]
+			break
+		}
+	}
+	if handle == "" || !handleRegex.MatchString(handle) {
+		return ProductURL{}, fmt.Errorf("Could not find a product handle in %q", u.Path)
+	}
+
+	variantID := u.Query().Get("variant")
+	if variantID != "" && !variantIDRegex.MatchString(variantID) {
+		return ProductURL{}, fmt.Errorf("Invalid variant %q in product URL", variantID)
+	}
+
+	return ProductURL{
+		Scheme:    u.Scheme,
+		Host:      strings.ToLower(u.Host),
+		Handle:    handle,
+		VariantID: variantID,
+	}, nil
+}
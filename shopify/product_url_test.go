@@ -0,0 +1,94 @@
+package shopify
+
+import "testing"
+
+func TestParseProductURL(t *testing.T) {
+	tests := []struct {
+		name          string
+		raw           string
+		defaultDomain string
+		want          ProductURL
+	}{
+		{
+			name: "full URL",
+			raw:  "https://www.example.com/products/dunk-low",
+			want: ProductURL{Scheme: "https", Host: "www.example.com", Handle: "dunk-low"},
+		},
+		{
+			name: "variant, locale and collection",
+			raw:  "https://www.example.com/en-gb/collections/footwear/products/dunk-low?variant=40000000000002&utm_source=x",
+			want: ProductURL{Scheme: "https", Host: "www.example.com", Handle: "dunk-low", VariantID: "40000000000002"},
+		},
+		{
+			name: "no scheme, port and upper case host",
+			raw:  "  WWW.Example.com:8443/products/dunk-low/ ",
+			want: ProductURL{Scheme: "https", Host: "www.example.com:8443", Handle: "dunk-low"},
+		},
+		{
+			name: "scheme relative",
+			raw:  "//www.example.com/products/dunk_low",
+			want: ProductURL{Scheme: "https", Host: "www.example.com", Handle: "dunk_low"},
+		},
+		{
+			name: "plain http",
+			raw:  "http://localhost:8080/products/dunk-low",
+			want: ProductURL{Scheme: "http", Host: "localhost:8080", Handle: "dunk-low"},
+		},
+		{
+			name:          "bare handle",
+			raw:           "dunk-low",
+			defaultDomain: "www.example.com",
+			want:          ProductURL{Scheme: "https", Host: "www.example.com", Handle: "dunk-low"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseProductURL(tt.raw, tt.defaultDomain)
+			if err != nil {
+				t.Fatalf("ParseProductURL(%q) error: %v", tt.raw, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseProductURL(%q) = %+v, want %+v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseProductURLErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		raw           string
+		defaultDomain string
+	}{
+		{"empty", "   ", "www.example.com"},
+		{"bare handle without domain", "dunk-low", ""},
+		{"unsupported scheme", "ftp://www.example.com/products/dunk-low", ""},
+		{"no host", "https:///products/dunk-low", ""},
+		{"not a product page", "https://www.example.com/collections/footwear", ""},
+		{"products without handle", "https://www.example.com/products/", ""},
+		{"non numeric variant", "https://www.example.com/products/dunk-low?variant=abc", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := ParseProductURL(tt.raw, tt.defaultDomain); err == nil {
+				t.Errorf("ParseProductURL(%q) = %+v, want an error", tt.raw, got)
+			}
+		})
+	}
+}
+
+func TestProductURLString(t *testing.T) {
+	p, err := ParseProductURL("https://www.example.com:8443/en-gb/products/dunk-low?variant=1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p.String(), "https://www.example.com:8443/products/dunk-low"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if got, want := p.Hostname(), "www.example.com"; got != want {
+		t.Errorf("Hostname() = %q, want %q", got, want)
+	}
+	if got, want := p.Path(), "products/dunk-low"; got != want {
+		t.Errorf("Path() = %q, want %q", got, want)
+	}
+}
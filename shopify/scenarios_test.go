@@ -0,0 +1,77 @@
+package shopify_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"alin/packages/session"
+	"alin/packages/shopify"
+	"alin/packages/shopify/data_handling"
+	"alin/packages/shopify/shopifytest"
+)
+
+// How each ready made scenario ends, by name. A nil error is a checkout that
+// placed exactly one order.
+var scenarioOutcomes = map[string]error{
+	shopifytest.HappyPath.Name:        nil,
+	shopifytest.RateLimitBurst.Name:   nil,
+	shopifytest.ServerErrorBurst.Name: nil,
+	shopifytest.CheckoutQueue.Name:    nil,
+	shopifytest.SlowProcessing.Name:   nil,
+	shopifytest.CardDeclined.Name:     shopify.ErrPaymentDeclined,
+	shopifytest.ThreeDSecure.Name:     shopify.ErrThreeDSecure,
+	shopifytest.OutOfStock.Name:       shopify.ErrSoldOut,
+	shopifytest.PasswordPage.Name:     shopify.ErrPasswordPage,
+	shopifytest.MissingTokens.Name:    session.ErrParse,
+}
+
+func TestScenarios(t *testing.T) {
+	for _, scenario := range shopifytest.Scenarios() {
+		scenario := scenario
+		want, ok := scenarioOutcomes[scenario.Name]
+		if !ok {
+			t.Errorf("no expected outcome for scenario %q", scenario.Name)
+			continue
+		}
+		t.Run(scenario.Name, func(t *testing.T) {
+			t.Parallel()
+			srv := shopifytest.NewServer(scenario)
+			defer srv.Close()
+
+			// The checkout queue needs a third attempt, failures that keep failing stop there
+			inst, err := srv.NewInstance(data_handling.Options{Profile: shopifytest.Profile(), Size: "UK 9", MaxAttempts: 3})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			err = inst.Run(ctx)
+
+			if ctx.Err() != nil {
+				t.Fatalf("Run didn't finish before the deadline: %v", err)
+			}
+			orders := len(srv.Orders())
+			if want == nil {
+				if err != nil || orders != 1 {
+					t.Fatalf("Run = %v with %d orders, want success with 1", err, orders)
+				}
+				// Each attempt adds to the cart, earlier attempts' items mustn't be checked out too
+				if quantity := srv.Orders()[0].Quantity; quantity != 1 {
+					t.Errorf("ordered %d items, want 1", quantity)
+				}
+				if state := inst.Status().State; state != shopify.StateSuccess {
+					t.Errorf("state %s, want Success", state)
+				}
+				return
+			}
+			if !errors.Is(err, want) {
+				t.Fatalf("Run = %v, want %v", err, want)
+			}
+			if orders != 0 {
+				t.Errorf("%d orders placed", orders)
+			}
+		})
+	}
+}
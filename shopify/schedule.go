@@ -0,0 +1,292 @@
+package shopify
+
+import (
+	"alin/packages/session"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	clockSamples = 8
+	// Re-measure the clock offset this long before the start, a long wait can drift
+	offsetRefreshLead = 30 * time.Second
+	// Tasks on the same store reuse a clock offset measured this recently
+	offsetMaxAge = 15 * time.Second
+	// Open connections to the store this long before the start unless Options.PrewarmLead is set
+	defaultPrewarmLead = 10 * time.Second
+)
+
+// EstimateClockOffset measures how far the server's clock is ahead of ours using
+// the Date header of several HEAD requests to url. Date only has one second
+// resolution, so samples are spread across a second and the bounds each one
+// gives are intersected. Samples aren't retried, and each is timed from when it
+// was written to the connection, so waiting on the host's limit doesn't count.
+func EstimateClockOffset(ctx context.Context, sess *session.Session, url string, samples int) (time.Duration, error) {
+	var (
+		lower, upper time.Duration
+		estimates    []time.Duration
+	)
+
+	for i := 0; i < samples; i++ {
+		if i > 0 {
+			// Step through different sub-second phases of the server clock
+			select {
+			case <-time.After(time.Second/time.Duration(samples) + 13*time.Millisecond):
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+		}
+
+		var (
+			mu             sync.Mutex
+			sent, received time.Time
+		)
+		trace := &httptrace.ClientTrace{
+			WroteRequest: func(httptrace.WroteRequestInfo) {
+				mu.Lock()
+				sent = time.Now()
+				mu.Unlock()
+			},
+			GotFirstResponseByte: func() {
+				mu.Lock()
+				received = time.Now()
+				mu.Unlock()
+			},
+		}
+		req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodHead, url, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("User-Agent", sess.Useragent)
+
+		before := time.Now()
+		resp, err := sess.Do(session.WithRetryPolicy(req, session.NoRetries()))
+		after := time.Now()
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+
+		serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			continue
+		}
+
+		// Replayed responses never touch a connection, so have no trace
+		mu.Lock()
+		if sent.IsZero() || received.IsZero() {
+			sent, received = before, after
+		}
+		mu.Unlock()
+
+		// The server read its clock somewhere between sent and received, and
+		// the true time was somewhere in [Date, Date+1s)
+		low := serverTime.Sub(received)
+		high := serverTime.Add(time.Second).Sub(sent)
+		if len(estimates) == 0 || low > lower {
+			lower = low
+		}
+		if len(estimates) == 0 || high < upper {
+			upper = high
+		}
+		estimates = append(estimates, serverTime.Add(500*time.Millisecond).Sub(sent.Add(received.Sub(sent)/2)))
+	}
+
+	if len(estimates) == 0 {
+		return 0, errors.New("Could not read a Date header from the store")
+	}
+
+	if lower <= upper {
+		return lower + (upper-lower)/2, nil
+	}
+
+	// Bounds disagree (slow or uneven responses), fall back to the median
+	sort.Slice(estimates, func(i, j int) bool {
+		return estimates[i] < estimates[j]
+	})
+	return estimates[len(estimates)/2], nil
+}
+
+// clockOffsets shares each store's clock offset between the tasks scheduled on
+// it, so a drop's tasks measure it once between them rather than once each
+var clockOffsets = struct {
+	mu     sync.Mutex
+	stores map[string]*clockMeasurement
+}{stores: map[string]*clockMeasurement{}}
+
+// clockMeasurement is one store's offset, ready once done is closed
+type clockMeasurement struct {
+	done   chan struct{}
+	at     time.Time
+	offset time.Duration
+	err    error
+}
+
+// storeClockOffset returns domain's clock offset, reusing a measurement taken in
+// the last maxAge or one still in progress. Otherwise it measures with sess.
+func storeClockOffset(ctx context.Context, sess *session.Session, domain string, maxAge time.Duration) (time.Duration, error) {
+	for {
+		clockOffsets.mu.Lock()
+		m, ok := clockOffsets.stores[domain]
+		if ok {
+			select {
+			case <-m.done:
+				ok = m.err == nil && time.Since(m.at) <= maxAge
+			default:
+			}
+		}
+		if !ok {
+			m = &clockMeasurement{done: make(chan struct{})}
+			clockOffsets.stores[domain] = m
+			clockOffsets.mu.Unlock()
+
+			m.offset, m.err = EstimateClockOffset(ctx, sess, fmt.Sprintf("https://%s/", domain), clockSamples)
+			m.at = time.Now()
+			close(m.done)
+			return m.offset, m.err
+		}
+		clockOffsets.mu.Unlock()
+
+		select {
+		case <-m.done:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		// The task measuring was stopped, the next to ask measures instead
+		if errors.Is(m.err, context.Canceled) || errors.Is(m.err, context.DeadlineExceeded) {
+			continue
+		}
+		return m.offset, m.err
+	}
+}
+
+// schedule is a task's planned start, read by the UI while the task waits
+type schedule struct {
+	mu          sync.RWMutex
+	startAt     time.Time     // Store time requested in Options.StartAt
+	clockOffset time.Duration // Store clock minus ours
+}
+
+func (s *schedule) set(startAt time.Time, offset time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.startAt = startAt
+	s.clockOffset = offset
+}
+
+// localStart returns the start time on our clock, zero if the task is not scheduled
+func (s *schedule) localStart() (time.Time, time.Duration) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.startAt.IsZero() {
+		return time.Time{}, 0
+	}
+	return s.startAt.Add(-s.clockOffset), s.clockOffset
+}
+
+// StartsIn returns how long until a scheduled task starts, or 0 when it is not waiting
+func (inst *Instance) StartsIn() time.Duration {
+	start, _ := inst.schedule.localStart()
+	if start.IsZero() {
+		return 0
+	}
+	if d := time.Until(start); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// waitForStart blocks until Options.StartAt on the store's clock
+func (inst *Instance) waitForStart(ctx context.Context) error {
+	startAt := inst.Options.StartAt
+	if startAt.IsZero() || time.Until(startAt) <= 0 {
+		return nil
+	}
+
+	measure := func() {
+		offset, err := storeClockOffset(ctx, inst.Session, inst.Domain, offsetMaxAge)
+		if err != nil {
+			inst.Logger.Info("Could not estimate clock offset, using local clock", zap.Error(err))
+		} else {
+			inst.Logger.Info("Clock offset", zap.Duration("Offset", offset))
+		}
+		inst.schedule.set(startAt, offset)
+		start, _ := inst.schedule.localStart()
+		inst.setStatus(StateIdle, fmt.Sprintf("Scheduled for %s (clock offset %s)", start.Format("15:04:05.000"), offset.Round(time.Millisecond)))
+	}
+
+	inst.schedule.set(startAt, 0)
+	measure()
+
+	start, _ := inst.schedule.localStart()
+	if refreshAt := start.Add(-offsetRefreshLead); time.Until(refreshAt) > 0 {
+		if err := sleepUntil(ctx, refreshAt); err != nil {
+			return err
+		}
+		measure()
+		start, _ = inst.schedule.localStart()
+	}
+
+	// Replayed tasks have no connections to open
+	if lead := inst.prewarmLead(); lead > 0 && inst.Options.ReplayHAR == "" {
+		if err := sleepUntil(ctx, start.Add(-lead)); err != nil {
+			return err
+		}
+		inst.prewarm(ctx, start)
+	}
+
+	if err := sleepUntil(ctx, start); err != nil {
+		return err
+	}
+	inst.schedule.set(time.Time{}, 0)
+	return nil
+}
+
+func (inst *Instance) prewarmLead() time.Duration {
+	if inst.Options.PrewarmLead == 0 {
+		return defaultPrewarmLead
+	}
+	return inst.Options.PrewarmLead
+}
+
+// prewarm opens connections to the task's hosts, giving up on any not open by start
+func (inst *Instance) prewarm(ctx context.Context, start time.Time) {
+	ctx, cancel := context.WithDeadline(ctx, start)
+	defer cancel()
+
+	var report []string
+	for _, w := range inst.Session.Prewarm(ctx, inst.hosts()...) {
+		switch {
+		case w.Err != nil:
+			inst.Logger.Info("Could not prewarm connection", zap.String("Host", w.Host), zap.Error(w.Err))
+			report = append(report, w.Host+" failed")
+		case w.Reused:
+			inst.Logger.Info("Connection already open", zap.String("Host", w.Host), zap.Duration("Total", w.Total))
+			report = append(report, w.Host+" already open")
+		default:
+			inst.Logger.Info("Prewarmed connection", zap.String("Host", w.Host), zap.Duration("DNS", w.DNS), zap.Duration("Connect", w.Connect), zap.Duration("Handshake", w.Handshake), zap.Duration("Total", w.Total))
+			report = append(report, fmt.Sprintf("%s %s", w.Host, (w.DNS+w.Connect+w.Handshake).Round(time.Millisecond)))
+		}
+	}
+	inst.setStatus(StateIdle, fmt.Sprintf("Scheduled for %s, connections open (%s)", start.Format("15:04:05.000"), strings.Join(report, ", ")))
+}
+
+func sleepUntil(ctx context.Context, t time.Time) error {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,93 @@
+package shopify
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"alin/packages/session"
+	"alin/packages/shopify/data_handling"
+)
+
+// newClockServer is a store whose clock runs offset ahead of ours, counting the
+// requests it gets
+func newClockServer(t *testing.T, offset time.Duration) (*httptest.Server, *session.Session, *int32) {
+	var hits int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Date", time.Now().Add(offset).UTC().Format(http.TimeFormat))
+	}))
+	t.Cleanup(srv.Close)
+	sess := session.NewSession(data_handling.Options{}, nil)
+	sess.SetTransport(srv.Client().Transport)
+	return srv, sess, &hits
+}
+
+func TestEstimateClockOffset(t *testing.T) {
+	const offset = 5*time.Second + 300*time.Millisecond
+	srv, sess, _ := newClockServer(t, offset)
+
+	// Waiting on the host's limit before a sample is sent isn't network time
+	u, _ := url.Parse(srv.URL)
+	host := u.Hostname()
+	session.SetHostLimit(host, session.HostLimit{Rate: 4, Burst: 1})
+	defer session.SetHostLimit(host, session.HostLimit{})
+
+	got, err := EstimateClockOffset(context.Background(), sess, srv.URL, clockSamples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := got - offset; diff < -150*time.Millisecond || diff > 150*time.Millisecond {
+		t.Errorf("offset %s, want about %s", got, offset)
+	}
+}
+
+func TestStoreClockOffsetShared(t *testing.T) {
+	srv, sess, hits := newClockServer(t, 2*time.Second)
+	u, _ := url.Parse(srv.URL)
+	domain := u.Host
+
+	// Tasks waiting on the same store share one measurement
+	var wg sync.WaitGroup
+	offsets := make([]time.Duration, 10)
+	for i := range offsets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			offset, err := storeClockOffset(context.Background(), sess, domain, time.Minute)
+			if err != nil {
+				t.Error(err)
+			}
+			offsets[i] = offset
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(hits); n != clockSamples {
+		t.Errorf("%d requests to the store, want one measurement of %d", n, clockSamples)
+	}
+	for _, offset := range offsets[1:] {
+		if offset != offsets[0] {
+			t.Errorf("offsets %v, want them all the same", offsets)
+			break
+		}
+	}
+
+	if _, err := storeClockOffset(context.Background(), sess, domain, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(hits); n != clockSamples {
+		t.Errorf("a recent measurement was taken again")
+	}
+	// An old one isn't reused
+	if _, err := storeClockOffset(context.Background(), sess, domain, 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(hits); n != 2*clockSamples {
+		t.Errorf("%d requests to the store, want a second measurement", n)
+	}
+}
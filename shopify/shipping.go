@@ -0,0 +1,43 @@
+package shopify
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	ShippingFirst    = "first"
+	ShippingCheapest = "cheapest"
+)
+
+// selectShippingRate picks a rate by strategy: "first" (the default), "cheapest",
+// or any other text to pick the first rate whose title contains it
+func selectShippingRate(rates []ShippingRate, strategy string) (ShippingRate, error) {
+	if len(rates) == 0 {
+		return ShippingRate{}, errors.New("No shipping rates available")
+	}
+
+	switch strings.ToLower(strings.TrimSpace(strategy)) {
+	case "", ShippingFirst:
+		return rates[0], nil
+	case ShippingCheapest:
+		cheapest := rates[0]
+		cheapestPrice, _ := strconv.ParseFloat(cheapest.Price, 64)
+		for _, rate := range rates[1:] {
+			price, err := strconv.ParseFloat(rate.Price, 64)
+			if err == nil && price < cheapestPrice {
+				cheapest, cheapestPrice = rate, price
+			}
+		}
+		return cheapest, nil
+	default:
+		for _, rate := range rates {
+			if strings.Contains(strings.ToLower(rate.Title), strings.ToLower(strategy)) {
+				return rate, nil
+			}
+		}
+		return ShippingRate{}, fmt.Errorf("No shipping rate matching %q", strategy)
+	}
+}
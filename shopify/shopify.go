@@ -4,15 +4,18 @@ import (
 	"alin/packages/session"
 	"alin/packages/shopify/data_handling"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"go.uber.org/zap"
 	"io"
+	"math"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -125,6 +128,10 @@ type ShopifyStore struct {
 	Code           string
 	CheckoutDomain string
 	DepositDomain  string
+	RateLimit      float64  // Requests per second to Domain across all tasks, 0 for no limit
+	RateBurst      int      // Requests sent at once before RateLimit kicks in
+	BaseURL        string   // Send all of the store's requests here instead, unless the task sets its own
+	CACerts        []string // PEM files of CA certificates to trust for the store
 }
 
 type Tokens struct {
@@ -145,8 +152,10 @@ type Instance struct {
 	Domain         string
 	ProductLoc     string
 	Session        *session.Session
-	Logger         *zap.Logger
-	Status         string
+	Logger         *zap.Logger // Tagged with the task, store and current step
+	taskLogger     *zap.Logger // Tagged with the task and store
+	status         statusTracker
+	schedule       schedule
 	Tokens         Tokens
 	ShippingRates  ShippingRates
 	ShippingRate   ShippingRate
@@ -154,84 +163,90 @@ type Instance struct {
 	Cart           Cart
 	TotalPrice     float64
 	Options        data_handling.Options
+	ctx            context.Context
+	har            *session.HARRecorder // Nil unless recording
+	harDir         string
+	checkpointPath string // Where progress is saved after each step, "" to not save it
+	carted         bool   // An add to cart was sent, the store's cart may still hold it
 }
 
-func NewShopifyInstance(options data_handling.Options) (*Instance, error) {
+// NewShopifyInstance validates the options and sets up a task. A nil logger discards the task's logs.
+func NewShopifyInstance(options data_handling.Options, logger *zap.Logger) (*Instance, error) {
 	inst := new(Instance)
 
-	r, _ := regexp.Compile("(?:https|http)\\://([\\w.]+)/([\\w\\d\\/-]+)?")
-	match := r.FindStringSubmatch(options.URL)
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
 
-	if len(match) < 2 {
-		fmt.Println("Could not regex match URL")
-		return nil, errors.New("could not match Regex")
-	} else {
-		inst.Domain = match[1]
-		inst.ProductLoc = match[2]
-	}
-
-	var stores []ShopifyStore
-	stores = append(stores, ShopifyStore{
-		Domain:         "launches.routeone.co.uk",
-		Code:           "50487623851",
-		CheckoutDomain: "checkout.shopifycs.com",
-		DepositDomain:  "deposit.us.shopifycs.com/sessions",
-	})
-	stores = append(stores, ShopifyStore{
-		Domain:         "www.routeone.co.uk",
-		Code:           "27442937933",
-		CheckoutDomain: "checkout.shopifycs.com",
-		DepositDomain:  "deposit.us.shopifycs.com/sessions",
-	})
-	stores = append(stores, ShopifyStore{
-		Domain:         "releases.flatspot.com",
-		Code:           "2744451133",
-		CheckoutDomain: "checkout.shopifycs.com",
-		DepositDomain:  "deposit.us.shopifycs.com/sessions",
-	})
-
-	matchedStore := false
-	for i := range stores {
-		if stores[i].Domain == inst.Domain {
-			// Found!
-			inst.Store = stores[i]
-			matchedStore = true
-		}
+	product, err := ParseProductURL(options.URL, options.Domain)
+	if err != nil {
+		return nil, err
 	}
+	inst.Domain = product.Host
+	inst.ProductLoc = product.Path()
 
-	if !matchedStore {
-		fmt.Println("Could not find store")
-		return nil, errors.New("Could not find store")
+	store, ok := LookupStore(product.Hostname())
+	if !ok {
+		return nil, fmt.Errorf("Could not find store %s", product.Hostname())
 	}
+	inst.Store = store
 
-	inst.Session = session.NewSession(options)
-	inst.Logger = session.NewLogger()
+	// An explicit variant ID wins over one taken from ?variant=
+	inst.VariantID = options.VariantID
+	if inst.VariantID == "" {
+		inst.VariantID = product.VariantID
+	}
+
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	inst.taskLogger = logger.With(zap.String("Store", store.Domain))
+	inst.Logger = inst.taskLogger
+	inst.Session = session.NewSession(options, inst.taskLogger)
+	inst.Session.OnLimiterWait(inst.limiterWait)
+	if err := inst.standIn(options); err != nil {
+		return nil, err
+	}
+	if options.ReplayHAR != "" {
+		if _, err := inst.Session.Replay(options.ReplayHAR); err != nil {
+			return nil, err
+		}
+	}
 	inst.TaskID = options.TaskID
-	inst.URL = options.URL
+	inst.URL = product.String()
 	inst.Profile = options.Profile
-	//inst.VariantID = options.VariantID
+	inst.Options = options
+	inst.ctx = context.Background()
 	return inst, nil
 }
 
 func (inst *Instance) getVariants() (bool, error) {
-	resp, err := inst.Session.Get(inst.URL, map[string][]string{})
-
+	req, err := inst.newRequest(http.MethodGet, inst.URL, nil, session.PresetNavigate, "")
 	if err != nil {
+		return false, err
 	}
 
-	if resp.StatusCode != 200 {
-		return false, errors.New("Could not retrieve variants")
+	resp, err := inst.Session.Do(req)
+	if err != nil {
+		return false, err
+	}
+	if passwordLocked(resp) {
+		resp.Body.Close()
+		return false, ErrPasswordPage
+	}
+	body, err := readBody(resp, http.StatusOK)
+	if err != nil {
+		return false, err
 	}
 
-	bodyBytes, err := io.ReadAll(resp.Body)
-	bodyString := string(bodyBytes)
-
-	r, _ := regexp.Compile(`"productVariants":(\[[\{\}\"\,\w\/\\\w-_.:=? ()]+\])`)
-	match := r.FindStringSubmatch(bodyString)
+	match, err := scrape(body, `"productVariants":(\[[\{\}\"\,\w\/\\\w-_.:=? ()]+\])`, "productVariants", inst.URL)
+	if err != nil {
+		return false, err
+	}
 
 	var m []Variant
-	if err := json.Unmarshal([]byte(match[1]), &m); err != nil {
-		panic(err)
+	if err := json.Unmarshal([]byte(match), &m); err != nil {
+		return false, &session.ParseError{Field: "productVariants", URL: inst.URL, Err: err}
 	}
 
 	for i := range m {
@@ -243,6 +258,10 @@ func (inst *Instance) getVariants() (bool, error) {
 
 	inst.Logger.Info("GET Variants", zap.String("Num. loaded", fmt.Sprintf("%d variants", len(m))))
 
+	if inst.VariantID == "" {
+		return false, fmt.Errorf("No variant matches size %q", inst.Options.Size)
+	}
+
 	return true, nil
 }
 
@@ -258,138 +277,110 @@ func (inst *Instance) cartVariant() (bool, error) {
 	}
 	payloadBytes, err := json.Marshal(data)
 	if err != nil {
-		// handle err
+		return false, err
 	}
 	body := bytes.NewReader(payloadBytes)
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://%s/cart/add.js", inst.Domain), body)
+	// Adding to a cart adds to the quantity already there, an earlier attempt's item would be bought too
+	if inst.carted {
+		if err := inst.clearCart(); err != nil {
+			inst.Logger.Info("Could not clear cart", zap.Error(err))
+			return false, err
+		}
+	}
+
+	req, err := inst.newRequest(http.MethodPost, fmt.Sprintf("https://%s/cart/add.js", inst.Domain), body, session.PresetXHRJSON, inst.productURL())
 	if err != nil {
-		// handle err
-	}
-	req.Host = inst.Domain
-	req.Header.Set("User-Agent", inst.Session.Useragent)
-	req.Header.Set("Accept", "application/json, text/plain, */*")
-	req.Header.Set("Accept-Language", "en-GB,en;q=0.5")
-	req.Header.Set("Origin", fmt.Sprintf("https://%s", inst.Domain))
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Referer", fmt.Sprintf("https://%s/%s?variant=%s", inst.Domain, inst.ProductLoc, inst.VariantID))
-	req.Header.Set("Sec-Fetch-Dest", "empty")
-	req.Header.Set("Sec-Fetch-Mode", "cors")
-	req.Header.Set("Sec-Fetch-Site", "same-origin")
-	req.Header.Set("Pragma", "no-cache")
-	req.Header.Set("Cache-Control", "no-cache")
-	req.Header.Set("Content-Type", "application/json;charset=utf-8")
-
-	resp, err := inst.Session.Client.Do(req)
+		return false, err
+	}
+
+	inst.carted = true
+	resp, err := inst.Session.Do(req)
 	if err != nil {
-		// handle err
+		return false, err
+	}
+	if passwordLocked(resp) {
+		resp.Body.Close()
+		return false, ErrPasswordPage
+	}
+	respDump, err := readBody(resp, http.StatusOK)
+	if err != nil {
+		inst.Logger.Info("Could not cart variant", zap.Error(err))
+		return false, err
 	}
-	respDump, err := io.ReadAll(resp.Body)
-	respStr := string(respDump)
 
-	inst.Logger.Debug("Cart", zap.String("Resp", respStr))
+	inst.Logger.Debug("Cart", zap.String("Resp", string(respDump)))
 
 	var cart Cart
-	if err := json.Unmarshal([]byte(respDump), &cart); err != nil {
-		panic(err)
+	if err := json.Unmarshal(respDump, &cart); err != nil {
+		return false, &session.ParseError{Field: "cart", URL: req.URL.String(), Err: err}
 	}
 
 	inst.Cart = cart
 
-	defer resp.Body.Close()
+	inst.setStatus(StateCarting, fmt.Sprintf("Added %s to cart @ £%.2f", cart.Title, float32(cart.Price)/100))
 
-	if resp.StatusCode != 200 {
-		inst.Logger.Info("Potential error", zap.String("Cart variant request status code", strconv.Itoa(resp.StatusCode)))
-		return false, errors.New("Could not cart variant")
-	}
+	return true, nil
+}
 
+// clearCart empties the store's cart
+func (inst *Instance) clearCart() error {
+	req, err := inst.newRequest(http.MethodPost, fmt.Sprintf("https://%s/cart/clear.js", inst.Domain), nil, session.PresetXHRJSON, inst.productURL())
 	if err != nil {
+		return err
 	}
-
-	inst.Status = fmt.Sprintf("Added %s to cart @ £%f", cart.Title, float32(cart.Price)/100)
-
-	return true, nil
+	resp, err := inst.Session.Do(req)
+	if err != nil {
+		return err
+	}
+	if passwordLocked(resp) {
+		resp.Body.Close()
+		return ErrPasswordPage
+	}
+	_, err = readBody(resp, http.StatusOK)
+	return err
 }
 
 func (inst *Instance) initCheckout() (bool, error) {
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://%s/checkout", inst.Domain), nil)
-	if err != nil {
-		// handle err
-	}
-	req.Host = inst.Domain
-	req.Header.Set("User-Agent", inst.Session.Useragent)
-	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8")
-	req.Header.Set("Accept-Language", "en-GB,en;q=0.5")
-	req.Header.Set("Origin", fmt.Sprintf("https://%s", inst.Domain))
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Referer", fmt.Sprintf("https://%s/%s?variant=%s", inst.Domain, inst.ProductLoc, inst.VariantID))
-	req.Header.Set("Upgrade-Insecure-Requests", "1")
-	req.Header.Set("Sec-Fetch-Dest", "document")
-	req.Header.Set("Sec-Fetch-Mode", "navigate")
-	req.Header.Set("Sec-Fetch-Site", "same-origin")
-	req.Header.Set("Sec-Fetch-User", "?1")
-	req.Header.Set("Pragma", "no-cache")
-	req.Header.Set("Cache-Control", "no-cache")
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := inst.Session.Client.Do(req)
+	req, err := inst.newRequest(http.MethodPost, fmt.Sprintf("https://%s/checkout", inst.Domain), nil, session.PresetFormPost, inst.productURL())
 	if err != nil {
-		// handle err
+		return false, err
 	}
-	respDump, err := io.ReadAll(resp.Body)
-	defer resp.Body.Close()
-	respStr := string(respDump)
+	// Shopify redirects to the new checkout, or somewhere else when it can't start one
+	req = session.WithRedirects(req, session.Follow(maxRedirects))
 
-	if resp.StatusCode != 302 {
-		inst.Logger.Info("Potential error", zap.String("Begin checkout request status code", strconv.Itoa(resp.StatusCode)))
+	resp, err := inst.Session.Do(req)
+	if err != nil {
+		return false, err
 	}
+	defer resp.Body.Close()
 
-	newLoc := resp.Header.Get("Location")
-
-	//if newLoc doesn't contain checkout return false
-	if !strings.Contains(newLoc, "checkout") {
-		inst.Logger.Info("Redirected back to cart")
+	landed := session.Landed(resp)
+	switch {
+	case strings.Contains(landed, "/throttle/queue"):
+		inst.Logger.Info("Sent to the checkout queue")
+		return false, errors.New("Sent to the checkout queue")
+	case strings.Contains(landed, "/stock_problems"):
+		inst.Logger.Info("Sold out at checkout")
+		return false, ErrSoldOut
+	case !strings.Contains(landed, "/checkouts/"):
+		inst.Logger.Info("Redirected back to cart", zap.String("Link", landed))
 		return false, errors.New("Redirected back to cart")
 	}
 
-	// Extract token
-	req, err = http.NewRequest("GET", newLoc, nil)
-	if err != nil {
-		// handle err
-	}
-
-	req.Host = inst.Domain
-	req.Header.Set("User-Agent", inst.Session.Useragent)
-	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8")
-	req.Header.Set("Accept-Language", "en-GB,en;q=0.5")
-	req.Header.Set("Referer", fmt.Sprintf("https://%s/%s?variant=%s", inst.Domain, inst.ProductLoc, inst.VariantID))
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Upgrade-Insecure-Requests", "1")
-	req.Header.Set("Sec-Fetch-Dest", "document")
-	req.Header.Set("Sec-Fetch-Mode", "navigate")
-	req.Header.Set("Sec-Fetch-Site", "same-origin")
-	req.Header.Set("Sec-Fetch-User", "?1")
-
-	resp, err = inst.Session.Client.Do(req)
+	respDump, err := readBody(resp, http.StatusOK)
 	if err != nil {
-		inst.Logger.Error("Error sending request", zap.Error(err))
+		return false, err
 	}
 
-	respDump, err = io.ReadAll(resp.Body)
-	respStr = string(respDump)
-
-	defer resp.Body.Close()
-
-	// Extract token with regex `Shopify.Checkout.token = "([\w]+)"` from respStr
-	r, _ := regexp.Compile(`Shopify.Checkout.token = "(\w+)"`)
-	match := r.FindStringSubmatch(respStr)
-
-	if len(match) < 2 {
+	// Extract token with regex `Shopify.Checkout.token = "([\w]+)"` from respDump
+	token, err := scrape(respDump, `Shopify.Checkout.token = "(\w+)"`, "Shopify.Checkout.token", landed)
+	if err != nil {
 		inst.Logger.Info("Could not regex match Shopify.Checkout.token")
-		return false, errors.New("Could not regex match Shopify.Checkout.token")
+		return false, err
 	}
 
-	inst.Tokens.ShopifyCheckoutToken = match[1]
+	inst.Tokens.ShopifyCheckoutToken = token
 
 	return true, nil
 }
@@ -397,43 +388,27 @@ func (inst *Instance) initCheckout() (bool, error) {
 func (inst *Instance) authToken() (bool, error) {
 	// Extract token
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/%s/checkouts/%s", inst.Domain, inst.Store.Code, inst.Tokens.ShopifyCheckoutToken), nil)
-	if err != nil {
-		// handle err
-	}
-
-	req.Host = inst.Domain
-	req.Header.Set("User-Agent", inst.Session.Useragent)
-	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8")
-	req.Header.Set("Accept-Language", "en-GB,en;q=0.5")
-	req.Header.Set("Referer", fmt.Sprintf("https://%s/%s?variant=%s", inst.Domain, inst.ProductLoc, inst.VariantID))
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Upgrade-Insecure-Requests", "1")
-	req.Header.Set("Sec-Fetch-Dest", "document")
-	req.Header.Set("Sec-Fetch-Mode", "navigate")
-	req.Header.Set("Sec-Fetch-Site", "same-origin")
-	req.Header.Set("Sec-Fetch-User", "?1")
-
-	resp, err := inst.Session.Client.Do(req)
+	req, err := inst.newRequest(http.MethodGet, inst.checkoutURL(""), nil, session.PresetNavigate, inst.productURL())
 	if err != nil {
-		inst.Logger.Error("Error sending request", zap.Error(err))
+		return false, err
 	}
 
-	respDump, err := io.ReadAll(resp.Body)
-	respStr := string(respDump)
-
-	defer resp.Body.Close()
-
-	// Extract token with regex `Shopify.Checkout.token = "([\w]+)"` from respStr
-	r, _ := regexp.Compile(`name=\"authenticity_token" value="([a-zA-Z0-9_-]+)\"`)
-	match := r.FindStringSubmatch(respStr)
+	resp, err := inst.Session.Do(req)
+	if err != nil {
+		return false, err
+	}
+	respDump, err := readBody(resp, http.StatusOK)
+	if err != nil {
+		return false, err
+	}
 
-	if len(match) < 2 {
+	token, err := scrape(respDump, `name=\"authenticity_token" value="([a-zA-Z0-9_-]+)\"`, "authenticity_token", req.URL.String())
+	if err != nil {
 		inst.Logger.Info("Could not regex match authenticity_token")
-		return false, errors.New("Could not regex match authenticity_token")
+		return false, err
 	}
 
-	inst.Tokens.AuthenticityToken = match[1]
+	inst.Tokens.AuthenticityToken = token
 
 	return true, nil
 }
@@ -464,273 +439,105 @@ func (inst *Instance) submitAddress() (bool, error) {
 	params.Add("checkout[client_details][browser_tz]", `-60`)
 	body := strings.NewReader(params.Encode())
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://%s/%s/checkouts/%s", inst.Domain, inst.Store.Code, inst.Tokens.ShopifyCheckoutToken), body)
+	req, err := inst.newRequest(http.MethodPost, inst.checkoutURL(""), body, session.PresetFormPost, inst.checkoutURL(""))
 	if err != nil {
-		// handle err
-	}
-	req.Host = inst.Domain
-	req.Header.Set("User-Agent", inst.Session.Useragent)
-	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8")
-	req.Header.Set("Accept-Language", "en-GB,en;q=0.5")
-	req.Header.Set("Origin", fmt.Sprintf("https://%s", inst.Domain))
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Referer", fmt.Sprintf("https://%s/%s?variant=%s", inst.Domain, inst.ProductLoc, inst.VariantID))
-	req.Header.Set("Upgrade-Insecure-Requests", "1")
-	req.Header.Set("Sec-Fetch-Dest", "document")
-	req.Header.Set("Sec-Fetch-Mode", "navigate")
-	req.Header.Set("Sec-Fetch-Site", "same-origin")
-	req.Header.Set("Sec-Fetch-User", "?1")
-	req.Header.Set("Pragma", "no-cache")
-	req.Header.Set("Cache-Control", "no-cache")
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := inst.Session.Client.Do(req)
+		return false, err
+	}
+
+	resp, err := inst.Session.Do(req)
 	if err != nil {
 		inst.Logger.Error("Error sending request", zap.Error(err))
 		return false, err
 	}
-
-	respDump, err := io.ReadAll(resp.Body)
-	respStr := string(respDump)
-
-	defer resp.Body.Close()
-	//respStr := string(respDump)
-
-	if resp.StatusCode != 302 {
-		inst.Logger.Info("Potential error", zap.String("Begin checkout request status code", strconv.Itoa(resp.StatusCode)), zap.String("Resp message", respStr))
+	// Shopify redirects to the next step, and shows the form again with errors when the address is rejected
+	if _, err := readBody(resp, http.StatusFound); err != nil {
+		inst.Logger.Info("Potential error", zap.Error(err))
+		return false, err
 	}
 
 	return true, nil
 }
 
 func (inst *Instance) deliveryToken() (bool, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/%s/checkouts/%s", inst.Domain, inst.Store.Code, inst.Tokens.ShopifyCheckoutToken), nil)
-
-	q := req.URL.Query()
-	q.Add("previous_step", "contact_information")
-	q.Add("step", "shipping_method")
-	req.URL.RawQuery = q.Encode()
-
+	req, err := inst.newRequest(http.MethodGet, inst.checkoutURL("?previous_step=contact_information&step=shipping_method"), nil, session.PresetNavigate, inst.checkoutURL(""))
 	if err != nil {
 		inst.Logger.Error("Error creating request", zap.Error(err))
 		return false, err
 	}
 
-	req.Host = inst.Domain
-	req.Header.Set("User-Agent", inst.Session.Useragent)
-	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8")
-	req.Header.Set("Accept-Language", "en-GB,en;q=0.5")
-	//req.Header.Set("Referer", fmt.Sprintf("https://%s/%s?variant=%s", inst.Domain, inst.ProductLoc, inst.VariantID))
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Upgrade-Insecure-Requests", "1")
-	req.Header.Set("Sec-Fetch-Dest", "document")
-	req.Header.Set("Sec-Fetch-Mode", "navigate")
-	req.Header.Set("Sec-Fetch-Site", "same-origin")
-	req.Header.Set("Sec-Fetch-User", "?1")
-
-	resp, err := inst.Session.Client.Do(req)
+	resp, err := inst.Session.Do(req)
 	if err != nil {
 		inst.Logger.Error("Error sending request", zap.Error(err))
+		return false, err
+	}
+	respDump, err := readBody(resp, http.StatusOK)
+	if err != nil {
+		return false, err
 	}
 
-	respDump, err := io.ReadAll(resp.Body)
-	respStr := string(respDump)
-
-	defer resp.Body.Close()
-
-	// Extract token with regex `Shopify.Checkout.token = "([\w]+)"` from respStr
-	r, _ := regexp.Compile(`name="authenticity_token" value="([a-zA-Z0-9_-]+)"`)
-	match := r.FindStringSubmatch(respStr)
-
-	if len(match) < 2 {
+	token, err := scrape(respDump, `name="authenticity_token" value="([a-zA-Z0-9_-]+)"`, "delivery authenticity_token", req.URL.String())
+	if err != nil {
 		inst.Logger.Info("Could not regex match delivery authenticity_token")
-		return false, errors.New("Could not regex match delivery authenticity_token")
+		return false, err
 	}
 
-	inst.Tokens.DeliveryAuthenticityToken = match[1]
+	inst.Tokens.DeliveryAuthenticityToken = token
 
-	// Extract token with regex `Shopify.Checkout.token = "([\w]+)"` from respStr
-	r, _ = regexp.Compile(`name="shopify-checkout-authorization-token" content="(.+)"`)
-	match = r.FindStringSubmatch(respStr)
-
-	if len(match) < 2 {
+	token, err = scrape(respDump, `name="shopify-checkout-authorization-token" content="(.+)"`, "shopify-checkout-authorization-token", req.URL.String())
+	if err != nil {
 		inst.Logger.Info("Could not regex match shopify-checkout-authorization-token")
-		return false, errors.New("Could not regex match shopify-checkout-authorization-token")
+		return false, err
 	}
 	//XShopifyCheckoutAuthorizationToken
-	inst.Tokens.XShopifyCheckoutAuthorizationToken = match[1]
+	inst.Tokens.XShopifyCheckoutAuthorizationToken = token
 
 	return true, nil
 }
 
 func (inst *Instance) getShippingRates() (bool, error) {
-	//cloudProxyHeaders := CloudProxyHeaders{
-	//	XShopifyCheckoutAuthorizationToken: inst.Tokens.XShopifyCheckoutAuthorizationToken,
-	//	Accept:                             "application/json",
-	//}
-	//cloudProxyPostData, err := json.Marshal(CloudProxy{
-	//	Cmd:        "request.get",
-	//	URL:        fmt.Sprintf("https://%s/api/checkouts/%s/shipping_rates", inst.Domain, inst.Tokens.ShopifyCheckoutToken),
-	//	UserAgent:  inst.Session.Useragent,
-	//	MaxTimeout: 10000,
-	//	Headers:    cloudProxyHeaders,
-	//})
-	//
-	//var jsonData = []byte(fmt.Sprintf(`{"cmd": "request.get", "url": "https://%s/api/checkouts/%s/shipping_rates", "userAgent": "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/101.0.4951.41 Safari/537.36", "maxTimeout": 60000, "headers": {"X-Shopify-Checkout-Authorization-Token": %s, "Accept": "application/json"}}`, inst.Domain, inst.Tokens.ShopifyCheckoutToken, inst.Tokens.XShopifyCheckoutAuthorizationToken))
-	//
-	//if err != nil {
-	//}
-	//
-	//fmt.Println("Create cloudProxyPostData", string(cloudProxyPostData))
-	//
-	//// Extract token
-	////shippingRatesUrl := fmt.Sprintf("https://%s/api/checkouts/%s/shipping_rates", inst.Domain, inst.Tokens.ShopifyCheckoutToken)
-	////req, err := http.NewRequest("GET", shippingRatesUrl, nil)
-	//req, err := http.NewRequest("POST", "http://localhost:8191/v1", bytes.NewBuffer(jsonData))
-	////req, err := http.NewRequest("GET", "https://httpbin.org/headers", nil)
-	//if err != nil {
-	//	// handle err
-	//}
-	//
-	//// Setup transport
-	//t := http.DefaultTransport.(*http.Transport).Clone()
-	//t.MaxIdleConns = 100
-	//t.MaxConnsPerHost = 100
-	//t.MaxIdleConnsPerHost = 100
-	//
-	////proxy := http.ProxyURL(&url.URL{
-	////	Scheme: "http",
-	////	Host:   "127.0.0.1:9090",
-	////})
-	////t.Proxy = proxy
-	//
-	//tempClient := &http.Client{
-	//	Transport: t,
-	//	CheckRedirect: func(req *http.Request, via []*http.Request) error {
-	//		return http.ErrUseLastResponse
-	//	},
-	//}
-	//
-	////req.Header = http.Header{}
-	//req.Host = inst.Domain
-	//req.Header.Set("X-Shopify-Checkout-Authorization-Token", inst.Tokens.XShopifyCheckoutAuthorizationToken)
-	//req.Header.Set("User-Agent", inst.Session.Useragent)
-	//req.Header.Set("Upgrade-Insecure-Requests", "1")
-	//req.Header.Set("Accept", "gzip")
-	//req.Header.Set("Connection", "keep-alive")
-	//
-	//var resp *http.Response
-	//
-	//for {
-	//	inst.Logger.Info("Retrieving shipping rates")
-	//	resp, err = tempClient.Do(req)
-	//	if err != nil {
-	//		inst.Logger.Error("Error sending request", zap.Error(err))
-	//	}
-	//
-	//	respDump, err := ioutil.ReadAll(resp.Body)
-	//	if err != nil {
-	//	}
-	//	respStr := string(respDump)
-	//	inst.Logger.Info("Shipping rates", zap.String("Rates resp", respStr))
-	//	time.Sleep(1 * time.Second)
-	//	defer resp.Body.Close()
-	//}
-
-	//{
-	// "shipping_rates": [
-	//   {
-	//     "id": "Store Pickup + Delivery-standard-3-5-working-days-3.99",
-	//     "price": "3.99",
-	//     "title": "Standard 3 - 5 Working Days",
-	//     "checkout": {
-	//       "total_tax": "9.00",
-	//       "total_price": "53.94",
-	//       "subtotal_price": "49.95"
-	//     },
-	//     "phone_required": false,
-	//     "delivery_range": [],
-	//     "estimated_time_in_transit": null
-	//   },
-	//   {
-	//     "id": "Store Pickup + Delivery-next-working-day-5.99",
-	//     "price": "5.99",
-	//     "title": "Next Working Day.",
-	//     "checkout": {
-	//       "total_tax": "9.33",
-	//       "total_price": "55.94",
-	//       "subtotal_price": "49.95"
-	//     },
-	//     "phone_required": false,
-	//     "delivery_range": [],
-	//     "estimated_time_in_transit": null
-	//   },
-	//   {
-	//     "id": "Store Pickup + Delivery-saturday-delivery-9.99",
-	//     "price": "9.99",
-	//     "title": "Saturday Delivery",
-	//     "checkout": {
-	//       "total_tax": "10.00",
-	//       "total_price": "59.94",
-	//       "subtotal_price": "49.95"
-	//     },
-	//     "phone_required": false,
-	//     "delivery_range": [],
-	//     "estimated_time_in_transit": null
-	//   }
-	// ]
-	//}
-
-	rawJson := `{
-	 "shipping_rates": [
-	   {
-	     "id": "Store Pickup + Delivery-standard-3-5-working-days-3.99",
-	     "price": "3.99",
-	     "title": "Standard 3 - 5 Working Days",
-	     "checkout": {
-	       "total_tax": "9.00",
-	       "total_price": "53.94",
-	       "subtotal_price": "49.95"
-	     },
-	     "phone_required": false,
-	     "delivery_range": [],
-	     "estimated_time_in_transit": null
-	   },
-	   {
-	     "id": "Store Pickup + Delivery-next-working-day-5.99",
-	     "price": "5.99",
-	     "title": "Next Working Day.",
-	     "checkout": {
-	       "total_tax": "9.33",
-	       "total_price": "55.94",
-	       "subtotal_price": "49.95"
-	     },
-	     "phone_required": false,
-	     "delivery_range": [],
-	     "estimated_time_in_transit": null
-	   },
-	   {
-	     "id": "Store Pickup + Delivery-saturday-delivery-9.99",
-	     "price": "9.99",
-	     "title": "Saturday Delivery",
-	     "checkout": {
-	       "total_tax": "10.00",
-	       "total_price": "59.94",
-	       "subtotal_price": "49.95"
-	     },
-	     "phone_required": false,
-	     "delivery_range": [],
-	     "estimated_time_in_transit": null
-	   }
-	 ]
-	}`
+	req, err := inst.newRequest(http.MethodGet, fmt.Sprintf("https://%s/api/checkouts/%s/shipping_rates.json", inst.Domain, inst.Tokens.ShopifyCheckoutToken), nil, session.PresetXHRJSON, inst.checkoutURL("?previous_step=contact_information&step=shipping_method"))
+	if err != nil {
+		inst.Logger.Error("Error creating request", zap.Error(err))
+		return false, err
+	}
+	req.Header.Set("X-Shopify-Checkout-Authorization-Token", inst.Tokens.XShopifyCheckoutAuthorizationToken)
+
+	// Shopify answers 202 while it is still calculating rates
+	var respDump []byte
+	for polls := 0; ; polls++ {
+		resp, err := inst.Session.Do(req)
+		if err != nil {
+			inst.Logger.Error("Error sending request", zap.Error(err))
+			return false, err
+		}
+		respDump, err = readBody(resp, http.StatusOK, http.StatusAccepted)
+		if err != nil {
+			inst.Logger.Info("Potential error", zap.Error(err))
+			return false, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+		if polls >= maxShippingRatePolls {
+			return false, session.NewUnexpectedStatusError(resp, respDump)
+		}
+		if err := inst.sleep(shippingRatePollInterval); err != nil {
+			return false, err
+		}
+	}
 
 	var shippingRates ShippingRates
-	if err := json.Unmarshal([]byte(rawJson), &shippingRates); err != nil {
+	if err := json.Unmarshal(respDump, &shippingRates); err != nil {
+		return false, &session.ParseError{Field: "shipping_rates", URL: req.URL.String(), Err: err}
+	}
+
+	rate, err := selectShippingRate(shippingRates.ShippingRate, inst.Options.ShippingStrategy)
+	if err != nil {
+		return false, err
 	}
 
 	inst.ShippingRates = shippingRates
-	inst.ShippingRate = shippingRates.ShippingRate[0]
+	inst.ShippingRate = rate
 
 	return true, nil
 }
@@ -741,8 +548,7 @@ func (inst *Instance) submitDelivery() (bool, error) {
 	params.Add("authenticity_token", inst.Tokens.DeliveryAuthenticityToken)
 	params.Add("previous_step", `shipping_method`)
 	params.Add("step", `payment_method`)
-	//params.Add("checkout[shipping_rate][id]", inst.ShippingRate.ID)
-	params.Add("checkout[shipping_rate][id]", "shopify-DPD%20Local%20Standard%20Shipping%20(1-3%20Business%20Days)-6.00")
+	params.Add("checkout[shipping_rate][id]", inst.ShippingRate.ID)
 	params.Add("checkout[client_details][browser_width]", `1280`)
 	params.Add("checkout[client_details][browser_height]", `643`)
 	params.Add("checkout[client_details][javascript_enabled]", `1`)
@@ -751,103 +557,67 @@ func (inst *Instance) submitDelivery() (bool, error) {
 	params.Add("checkout[client_details][browser_tz]", `-60`)
 	body := strings.NewReader(params.Encode())
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://%s/%s/checkouts/%s", inst.Domain, inst.Store.Code, inst.Tokens.ShopifyCheckoutToken), body)
+	req, err := inst.newRequest(http.MethodPost, inst.checkoutURL(""), body, session.PresetFormPost, inst.checkoutURL("?previous_step=contact_information&step=shipping_method"))
 	if err != nil {
-		// handle err
-	}
-	// TODO: Change host to be taken from inst.Store
-	req.Host = inst.Domain
-	req.Header.Set("User-Agent", inst.Session.Useragent)
-	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8")
-	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
-	req.Header.Set("Accept-Language", "en-GB,en;q=0.5")
-	req.Header.Set("Referer", fmt.Sprintf("https://%s/", inst.Domain))
-	req.Header.Set("Origin", fmt.Sprintf("https://%s/", inst.Domain))
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Upgrade-Insecure-Requests", "1")
-	req.Header.Set("Sec-Fetch-Dest", "document")
-	req.Header.Set("Sec-Fetch-Mode", "navigate")
-	req.Header.Set("Sec-Fetch-Site", "same-origin")
-	req.Header.Set("Sec-Fetch-User", "?1")
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := inst.Session.Client.Do(req)
-	if err != nil {
-		// handle err
+		return false, err
 	}
 
-	defer resp.Body.Close()
+	resp, err := inst.Session.Do(req)
+	if err != nil {
+		return false, err
+	}
+	if _, err := readBody(resp, http.StatusFound); err != nil {
+		inst.Logger.Info("Potential error", zap.Error(err))
+		return false, err
+	}
 
 	return true, nil
 }
 
 func (inst *Instance) getGateway() (bool, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/%s/checkouts/%s?previous_step=shipping_method&step=payment_method", inst.Domain, inst.Store.Code, inst.Tokens.ShopifyCheckoutToken), nil)
+	req, err := inst.newRequest(http.MethodGet, inst.checkoutURL("?previous_step=shipping_method&step=payment_method"), nil, session.PresetNavigate, inst.checkoutURL("?previous_step=contact_information&step=shipping_method"))
 	if err != nil {
 		inst.Logger.Error("Error creating request", zap.Error(err))
-		// handle err
-	}
-	// TODO: Change host to be taken from inst.Store
-	req.Host = inst.Domain
-	req.Header.Set("User-Agent", inst.Session.Useragent)
-	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8")
-	//req.Header.Set("Content-Type", "text/html; charset=utf-8")
-	//req.Header.Set("Accept-Encoding", "deflate, br")
-	req.Header.Set("Accept-Language", "en-GB,en;q=0.5")
-	req.Header.Set("Referer", fmt.Sprintf("https://%s/", inst.Domain))
-	//req.Header.Set("Origin", fmt.Sprintf("https://%s/", inst.Domain))
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Upgrade-Insecure-Requests", "1")
-	req.Header.Set("Sec-Fetch-Dest", "document")
-	req.Header.Set("Sec-Fetch-Mode", "navigate")
-	req.Header.Set("Sec-Fetch-Site", "same-origin")
-	req.Header.Set("Sec-Fetch-User", "?1")
-
-	resp, err := inst.Session.Client.Do(req)
-	if err != nil {
-		// handle err
+		return false, err
 	}
 
-	respDump, err := io.ReadAll(resp.Body)
-	respStr := string(respDump)
-
-	defer resp.Body.Close()
-
-	// Extract token with regex `data-select-gateway="(.+)"` from respStr
-	r, _ := regexp.Compile(`data-select-gateway="(.+)"`)
-	match := r.FindStringSubmatch(respStr)
+	resp, err := inst.Session.Do(req)
+	if err != nil {
+		return false, err
+	}
+	respDump, err := readBody(resp, http.StatusOK)
+	if err != nil {
+		return false, err
+	}
+	pageURL := req.URL.String()
 
-	if len(match) < 2 {
+	gateway, err := scrape(respDump, `data-select-gateway="(.+)"`, "checkout gateway", pageURL)
+	if err != nil {
 		inst.Logger.Info("Could not regex match checkout gateway")
-		return false, errors.New("Could not regex match checkout gateway")
+		return false, err
 	}
 
-	inst.Tokens.CheckoutGateway = match[1]
+	inst.Tokens.CheckoutGateway = gateway
 
-	// Extract token with regex `data-select-gateway="(.+)"` from respStr
-	r, _ = regexp.Compile(`Shopify.Checkout.totalPrice = (.+);`)
-	match = r.FindStringSubmatch(respStr)
-
-	if len(match) < 2 {
+	totalPrice, err := scrape(respDump, `Shopify.Checkout.totalPrice = (.+);`, "total price", pageURL)
+	if err != nil {
 		inst.Logger.Info("Could not regex match total price")
-		return false, errors.New("Could not regex match checkout gateway")
+		return false, err
 	}
 
-	inst.TotalPrice, err = strconv.ParseFloat(match[1], 64)
+	inst.TotalPrice, err = strconv.ParseFloat(totalPrice, 64)
 	if err != nil {
 		inst.Logger.Error("Error parsing total price", zap.Error(err))
+		return false, &session.ParseError{Field: "total price", URL: pageURL, Err: err}
 	}
 
-	// Extract token with regex `name="authenticity_token" value="([a-zA-Z0-9_-]+)"` from respStr
-	r, _ = regexp.Compile(`name="authenticity_token" value="([a-zA-Z0-9_-]+)"`)
-	match = r.FindStringSubmatch(respStr)
-
-	if len(match) < 2 {
+	token, err := scrape(respDump, `name="authenticity_token" value="([a-zA-Z0-9_-]+)"`, "checkout authenticity_token", pageURL)
+	if err != nil {
 		inst.Logger.Info("Could not regex match checkout authenticity_token")
-		return false, errors.New("Could not regex match checkout authenticity_token")
+		return false, err
 	}
 
-	inst.Tokens.CheckoutToken = match[1]
+	inst.Tokens.CheckoutToken = token
 
 	return true, nil
 }
@@ -866,39 +636,38 @@ func (inst *Instance) createPaymentSession() (bool, error) {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		inst.Logger.Error("Error marshalling data", zap.Error(err))
+		return false, err
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://%s", inst.Store.DepositDomain), bytes.NewBuffer(jsonData))
+	req, err := inst.newRequest(http.MethodPost, fmt.Sprintf("https://%s", inst.Store.DepositDomain), bytes.NewBuffer(jsonData), session.PresetXHRJSON, inst.checkoutURL("?previous_step=shipping_method&step=payment_method"))
 	if err != nil {
 		inst.Logger.Error("Error creating request", zap.Error(err))
+		return false, err
 	}
 
-	req.Host = inst.Domain
-	req.Header.Set("User-Agent", inst.Session.Useragent)
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Referer", fmt.Sprintf("https://%s", inst.Domain))
-	req.Header.Set("Origin", fmt.Sprintf("https://%s/", inst.Domain))
-	req.Header.Set("Accept-Encoding", "br")
-
-	resp, err := inst.Session.Client.Do(req)
+	resp, err := inst.Session.Do(req)
 	if err != nil {
 		inst.Logger.Error("Error sending request", zap.Error(err))
+		return false, err
 	}
 
-	respDump, err := io.ReadAll(resp.Body)
-	respStr := string(respDump)
+	inst.Logger.Info("Payment session", zap.Int("Status code", resp.StatusCode))
 
-	defer resp.Body.Close()
+	respDump, err := readBody(resp, http.StatusOK)
+	if err != nil {
+		return false, err
+	}
 
 	type PaymentId struct {
 		ID string `json:"id"`
 	}
 
-	inst.Logger.Info("Payment session", zap.String("Payment session resp", respStr))
-
 	var paymentID PaymentId
-	if err := json.Unmarshal([]byte(respDump), &paymentID); err != nil {
+	if err := json.Unmarshal(respDump, &paymentID); err != nil {
+		return false, &session.ParseError{Field: "payment session id", URL: req.URL.String(), Err: err}
+	}
+	if paymentID.ID == "" {
+		return false, &session.ParseError{Field: "payment session id", URL: req.URL.String()}
 	}
 
 	inst.PaymentGateway = paymentID.ID
@@ -919,7 +688,7 @@ func (inst *Instance) submitPayment() (bool, error) {
 	params.Add("checkout[remember_me]", `false`)
 	params.Add("checkout[remember_me]", `0`)
 	params.Add("checkout[vault_phone]", fmt.Sprintf("+44%s", inst.Profile.Phone))
-	params.Add("checkout[total_price]", fmt.Sprintf("%v", int(inst.TotalPrice*100)))
+	params.Add("checkout[total_price]", strconv.Itoa(int(math.Round(inst.TotalPrice*100))))
 	params.Add("complete", "1")
 	params.Add("checkout[client_details][browser_width]", strconv.Itoa(rand.Intn(2000-1000)+1000))
 	params.Add("checkout[client_details][browser_height]", strconv.Itoa(rand.Intn(2000-1000)+1000))
@@ -930,117 +699,199 @@ func (inst *Instance) submitPayment() (bool, error) {
 
 	body := strings.NewReader(params.Encode())
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://%s/%s/checkouts/%s", inst.Domain, inst.Store.Code, inst.Tokens.ShopifyCheckoutToken), body)
+	req, err := inst.newRequest(http.MethodPost, inst.checkoutURL(""), body, session.PresetFormPost, inst.checkoutURL("?previous_step=shipping_method&step=payment_method"))
 	if err != nil {
-		// handle err
-	}
-	// TODO: Change host to be taken from inst.Store
-	req.Host = inst.Domain
-	req.Header.Set("User-Agent", inst.Session.Useragent)
-	req.Header.Set("Accept-Language", "en-GB,en;q=0.5")
-	req.Header.Set("Referer", fmt.Sprintf("https://%s/", inst.Domain))
-	req.Header.Set("Origin", fmt.Sprintf("https://%s/", inst.Domain))
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Upgrade-Insecure-Requests", "1")
-	req.Header.Set("Sec-Fetch-Dest", "document")
-	req.Header.Set("Sec-Fetch-Mode", "navigate")
-	req.Header.Set("Sec-Fetch-Site", "same-origin")
-	req.Header.Set("Sec-Fetch-User", "?1")
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := inst.Session.Client.Do(req)
+		return false, err
+	}
+
+	// Stop at processing to poll it, or at thank_you when the payment went straight through
+	req = session.WithRedirects(req, session.FollowUntil(`/processing|/thank_you`, maxRedirects))
+	// Even a 429 or 503 may come from something in front of the store that passed
+	// the payment on, so it's never sent twice
+	req = session.WithRetryPolicy(req, session.NoRetries())
+
+	resp, err := inst.Session.Do(req)
 	if err != nil {
+		// The store may have taken the payment before the connection failed
 		inst.Logger.Error("Error sending payment request", zap.Error(err))
-		return false, err
+		return false, fmt.Errorf("%w: %v", ErrPaymentPending, err)
 	}
 
 	respDump, err := io.ReadAll(resp.Body)
-	respStr := string(respDump)
+	resp.Body.Close()
+	if err != nil {
+		inst.Logger.Error("Error reading payment request body", zap.Error(err))
+	}
 
-	if resp.StatusCode != 302 {
-		if err != nil {
-			inst.Logger.Error("Error reading payment request body", zap.Error(err))
-		}
-		inst.Logger.Info("Potential error", zap.String("Payment request status code", strconv.Itoa(resp.StatusCode)), zap.String("Response body", respStr))
+	if len(session.RedirectChain(resp)) == 1 && resp.StatusCode != http.StatusFound {
+		inst.Logger.Info("Potential error", zap.String("Payment request status code", strconv.Itoa(resp.StatusCode)), zap.String("Response body", string(respDump)))
+		// The request reached something, which can't be trusted to mean the store ignored it
+		return false, fmt.Errorf("%w: %v", ErrPaymentPending, session.NewUnexpectedStatusError(resp, respDump))
 	}
-	defer resp.Body.Close()
 
-	// ? If 302, check if location contains /processing
-	if strings.Contains(resp.Header.Get("Location"), "/processing") {
-
-		fmt.Print("\nProcessing")
-
-		for true {
-			fmt.Print(".")
-			parsedUrl, err := url.Parse(resp.Header.Get("Location"))
-			if err != nil {
-				inst.Logger.Error("Error parsing redirect URL", zap.Error(err))
-			}
-			req.Header.Del("Content-Type")
-			req.URL = parsedUrl
-
-			resp, err := inst.Session.Client.Do(req)
-			if err != nil {
-				inst.Logger.Error("Error sending payment request", zap.Error(err))
-				return false, err
-			}
-
-			respDump, err := io.ReadAll(resp.Body)
-			respStr := string(respDump)
-
-			if resp.StatusCode != 302 {
-				if err != nil {
-					inst.Logger.Error("Error reading payment request body", zap.Error(err))
-				}
-				inst.Logger.Info("Potential error", zap.String("Payment request status code", strconv.Itoa(resp.StatusCode)), zap.String("Response body", respStr))
-			}
-			defer resp.Body.Close()
-		}
+	if err := inst.awaitPayment(session.Landed(resp)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// awaitPayment polls the processing page at landed until the payment is done.
+// It returns nil once the checkout reaches thank_you, ErrPaymentDeclined or
+// ErrThreeDSecure when the payment didn't go through, and ErrPaymentPending when
+// polling stopped before it was known.
+func (inst *Instance) awaitPayment(landed string) error {
+	landed, err := inst.pollProcessing(landed)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPaymentPending, err)
 	}
 
-	if !strings.Contains(resp.Header.Get("Location"), "processing") || !strings.Contains(resp.Header.Get("Location"), "/thank_you") {
-		inst.Logger.Info("Potential 3DS", zap.String("Status code", strconv.Itoa(resp.StatusCode)), zap.String("Link", resp.Header.Get("Location")))
-		fmt.Println("Potential 3DS", resp.Header.Get("Location"))
-		time.Sleep(2 * time.Minute)
+	if strings.Contains(landed, "/thank_you") {
+		inst.Logger.Info("Successfully Checked Out!!")
+		return nil
 	}
 
-	success := false
-	for success {
-		time.Sleep(2 * time.Second)
-		req.URL, err = url.Parse(resp.Header.Get("Location"))
-		req.Body = nil
+	// Processing finished somewhere other than thank_you, Shopify sends declines back to the payment step
+	if strings.Contains(landed, inst.Tokens.ShopifyCheckoutToken) {
+		inst.Logger.Info("Payment declined", zap.String("Link", landed))
+		return ErrPaymentDeclined
+	}
+
+	// The buyer has to finish the challenge themselves, paying again could place a second order
+	inst.Logger.Info("Potential 3DS", zap.String("Link", landed))
+	return fmt.Errorf("%w: %s", ErrThreeDSecure, landed)
+}
 
+// pollProcessing reloads the processing page at landed until it sends the buyer
+// elsewhere, returning where that was
+func (inst *Instance) pollProcessing(landed string) (string, error) {
+	// The processing page answers 200 until the payment is done, then redirects.
+	// Each poll follows that, so declines land on the payment step and 3DS on the bank's page.
+	for polls := 0; strings.Contains(landed, "/processing"); polls++ {
+		if polls >= maxProcessingPolls {
+			return "", errors.New("Gave up waiting for payment to process")
+		}
+		inst.setStatus(StateProcessing, "Processing payment")
+		if err := inst.sleep(processingPollInterval); err != nil {
+			return "", err
+		}
+
+		pollReq, err := inst.newRequest(http.MethodGet, landed, nil, session.PresetNavigate, inst.checkoutURL("?previous_step=shipping_method&step=payment_method"))
 		if err != nil {
-			inst.Logger.Error("Error parsing redirect URL", zap.Error(err))
+			inst.Logger.Error("Error creating request", zap.Error(err))
+			return "", err
 		}
-		resp, err := inst.Session.Client.Do(req)
+		pollReq = session.WithRedirects(pollReq, session.FollowUntil(`/thank_you`, maxRedirects))
+
+		pollResp, err := inst.Session.Do(pollReq)
 		if err != nil {
 			inst.Logger.Error("Error checking checkout progress", zap.Error(err))
+			return "", err
 		}
+		io.Copy(io.Discard, pollResp.Body)
+		pollResp.Body.Close()
 
-		if strings.Contains(resp.Header.Get("Location"), "/thank_you") {
-			inst.Logger.Info("Successfully Checked Out!!")
-			success = true
-		}
-		if strings.Contains(resp.Header.Get("Location"), "/processing") {
-			inst.Logger.Info("Processing payment")
+		landed = session.Landed(pollResp)
+	}
+	return landed, nil
+}
+
+var (
+	ErrPaymentDeclined = errors.New("Payment declined")
+	ErrThreeDSecure    = errors.New("Payment needs 3DS")
+	ErrSoldOut         = errors.New("Sold out at checkout")
+	ErrPasswordPage    = errors.New("Store is password protected")
+	ErrPaymentPending  = errors.New("Payment sent but not confirmed")
+)
+
+// passwordLocked reports whether resp sends the buyer to the store's password page
+func passwordLocked(resp *http.Response) bool {
+	return resp.StatusCode >= 300 && resp.StatusCode < 400 && strings.Contains(resp.Header.Get("Location"), "/password")
+}
+
+// standIn points the session at a local stand-in for the store when the options or
+// the registry give a base URL, trusting any extra CA certificates
+func (inst *Instance) standIn(options data_handling.Options) error {
+	certs := append(append([]string(nil), inst.Store.CACerts...), options.CACerts...)
+	if err := inst.Session.TrustCertificates(certs...); err != nil {
+		return err
+	}
+
+	baseURL := options.BaseURL
+	if baseURL == "" {
+		baseURL = inst.Store.BaseURL
+	}
+	if baseURL == "" {
+		return nil
+	}
+	// The stand-in serves the checkout and card vault hosts too
+	for _, host := range inst.hosts() {
+		if err := inst.Session.OverrideHost(host, baseURL); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		switch resp.StatusCode {
-		case 302:
-			inst.Logger.Info("Payment request status code", zap.String("Payment request status code", strconv.Itoa(resp.StatusCode)), zap.String("Response body", respStr))
-			break
-		case 200:
-			inst.Logger.Info("Payment request status code", zap.String("Payment request status code", strconv.Itoa(resp.StatusCode)), zap.String("Response body", respStr))
-			break
+// hosts are the storefront, checkout and card vault hosts the task sends requests to
+func (inst *Instance) hosts() []string {
+	var hosts []string
+	seen := map[string]bool{"": true}
+	for _, host := range []string{inst.Domain, inst.Store.CheckoutDomain, strings.SplitN(inst.Store.DepositDomain, "/", 2)[0]} {
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
 		}
 	}
+	return hosts
+}
 
-	fmt.Println("3DS URL: ", resp.Header.Get("Location"))
+// newRequest builds a request with the preset's headers, as if sent from the store page at referer
+func (inst *Instance) newRequest(method, target string, body io.Reader, preset session.HeaderPreset, referer string) (*http.Request, error) {
+	return inst.Session.NewRequest(inst.ctx, method, target, body, preset, session.Page{Domain: inst.Domain, Referer: referer})
+}
 
-	return true, nil
+// productURL is the product page with the chosen variant selected
+func (inst *Instance) productURL() string {
+	return fmt.Sprintf("https://%s/%s?variant=%s", inst.Domain, inst.ProductLoc, inst.VariantID)
+}
+
+// checkoutURL is the checkout page, with query ("?step=...") appended
+func (inst *Instance) checkoutURL(query string) string {
+	return fmt.Sprintf("https://%s/%s/checkouts/%s%s", inst.Domain, inst.Store.Code, inst.Tokens.ShopifyCheckoutToken, query)
+}
+
+// readBody reads and closes resp's body, returning an UnexpectedStatusError
+// unless it has one of the wanted status codes
+func readBody(resp *http.Response, want ...int) ([]byte, error) {
+	defer resp.Body.Close()
+	if err := session.CheckStatus(resp, want...); err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &session.TransportError{Method: resp.Request.Method, URL: resp.Request.URL.String(), Err: err}
+	}
+	return body, nil
 }
 
+// scrape returns the first group of pattern in body, or a ParseError naming field when it isn't there
+func scrape(body []byte, pattern string, field string, pageURL string) (string, error) {
+	r := regexp.MustCompile(pattern)
+	match := r.FindSubmatch(body)
+	if len(match) < 2 {
+		return "", &session.ParseError{Field: field, URL: pageURL}
+	}
+	return string(match[1]), nil
+}
+
+const (
+	processingPollInterval   = 2 * time.Second
+	maxProcessingPolls       = 60
+	shippingRatePollInterval = 500 * time.Millisecond
+	maxShippingRatePolls     = 20
+	maxRedirects             = 5
+)
+
 func (inst *Instance) printStatus(text string) {
 	fmt.Printf("[TASK %d] %s\n", inst.TaskID, text)
 }
@@ -1063,121 +914,177 @@ func writeToFile(fileName string, text string) (success bool, err error) {
 	return true, nil
 }
 
-func (inst *Instance) run() {
-	for true {
-		inst.Status = "Getting variants"
-		_, err := inst.wrap(inst.getVariants)
-		if err != nil {
-			continue
-		}
+type checkoutStep struct {
+	Name    string // Added to every log line the step writes
+	State   TaskState
+	Message string
+	Run     func() (bool, error)
+}
 
-		inst.Status = "Carting variants"
-		_, err = inst.wrap(inst.cartVariant)
-		if err != nil {
-			continue
-		}
+func (inst *Instance) checkoutSteps() []checkoutStep {
+	var steps []checkoutStep
 
-		inst.Status = "Initializing checkout"
-		_, err = inst.wrap(inst.initCheckout)
-		if err != nil {
-			continue
-		}
+	// Skip the product page when the variant is already known
+	if inst.VariantID == "" {
+		steps = append(steps, checkoutStep{"variants", StateMonitoring, "Getting variants", inst.getVariants})
+	}
 
-		inst.Status = "Getting authorization token"
-		_, err = inst.wrap(inst.authToken)
-		if err != nil {
-			continue
-		}
+	return append(steps,
+		checkoutStep{"cart", StateCarting, "Carting variants", inst.cartVariant},
+		checkoutStep{"checkout", StateCheckout, "Initializing checkout", inst.initCheckout},
+		checkoutStep{"auth_token", StateCheckout, "Getting authorization token", inst.authToken},
+		checkoutStep{"address", StateCheckout, "Submitting address", inst.submitAddress},
+		checkoutStep{"delivery_token", StateCheckout, "Getting delivery token", inst.deliveryToken},
+		checkoutStep{"shipping_rates", StateCheckout, "Getting shipping rates", inst.getShippingRates},
+		checkoutStep{"delivery", StateCheckout, "Submitting delivery", inst.submitDelivery},
+		checkoutStep{"gateway", StateCheckout, "Getting gateway", inst.getGateway},
+		checkoutStep{"payment_session", StateProcessing, "Creating payment session", inst.createPaymentSession},
+		checkoutStep{"payment", StateProcessing, "Submitting payment", inst.submitPayment},
+	)
+}
 
-		inst.Status = "Submitting address"
-		_, err = inst.wrap(inst.submitAddress)
-		if err != nil {
-			continue
+// attempt runs every checkout step once, stopping at the first failure. A resumed
+// checkout skips the steps up to and including after.
+func (inst *Instance) attempt(after string) error {
+	steps := inst.checkoutSteps()
+	if after == "" {
+		inst.clearCheckpoint()
+	}
+	for i, step := range steps {
+		if step.Name == after {
+			steps = steps[i+1:]
+			break
 		}
+	}
 
-		inst.Status = "Getting delivery token"
-		_, err = inst.wrap(inst.deliveryToken)
-		if err != nil {
-			continue
+	for _, step := range steps {
+		if err := inst.ctx.Err(); err != nil {
+			return err
 		}
-
-		inst.Status = "Getting shipping rates"
-		_, err = inst.wrap(inst.getShippingRates)
-		if err != nil {
-			continue
+		inst.Logger = inst.taskLogger.With(zap.String("Step", step.Name))
+		inst.setStatus(step.State, step.Message)
+		if _, err := inst.wrap(step.Run); err != nil {
+			return err
 		}
+		inst.checkpoint(step.Name)
+	}
+	inst.Logger = inst.taskLogger
+	return nil
+}
 
-		inst.Status = "Submitting delivery"
-		_, err = inst.wrap(inst.submitDelivery)
-		if err != nil {
-			continue
+// Run retries the checkout until it succeeds, the payment is declined or needs 3DS,
+// Options.MaxAttempts runs out or ctx is cancelled. It returns nil on success. The
+// first attempt carries on from a saved checkpoint when its checkout is still valid.
+// Once a payment has been sent it is never sent again: if it can't be confirmed the
+// task stops with ErrPaymentPending, and starting it again waits on that payment.
+func (inst *Instance) Run(ctx context.Context) error {
+	inst.ctx = ctx
+	after, done, err := inst.resume()
+	if err != nil {
+		if ctx.Err() != nil {
+			inst.setStatus(StateStopped, "Stopped")
+			return ctx.Err()
 		}
-
-		inst.Status = "Getting gateway"
-		_, err = inst.wrap(inst.getGateway)
-		if err != nil {
-			continue
+		if !inst.paymentFailed(err) {
+			inst.setStatus(StateError, err.Error())
 		}
+		return err
+	}
+	if done {
+		inst.clearCheckpoint()
+		inst.setStatus(StateSuccess, "Checked out before the restart")
+		return nil
+	}
 
-		inst.Status = "Creating payment session"
-		_, err = inst.wrap(inst.createPaymentSession)
-		if err != nil {
-			continue
+	for n := 1; ; n++ {
+		err := inst.attempt(after)
+		after = ""
+		inst.saveHAR(n)
+		if err == nil {
+			inst.clearCheckpoint()
+			inst.setStatus(StateSuccess, "Checked out")
+			return nil
+		}
+		if ctx.Err() != nil {
+			inst.setStatus(StateStopped, "Stopped")
+			return ctx.Err()
+		}
+		if inst.paymentFailed(err) {
+			return err
+		}
+		inst.setStatus(StateError, err.Error())
+		if errors.Is(err, ErrPaymentPending) {
+			// The checkpoint is kept, so starting the task again checks on the payment
+			return err
+		}
+		if max := inst.Options.MaxAttempts; max > 0 && n >= max {
+			inst.Logger.Info("Giving up", zap.Int("Attempts", n), zap.Error(err))
+			return err
 		}
 
-		inst.Status = "Submitting payment"
-		_, err = inst.wrap(inst.submitPayment)
-		if err != nil {
-			continue
+		// Don't restart straight away, the store is likely failing for everyone
+		timer := time.NewTimer(inst.Session.Backoff(n))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			inst.setStatus(StateStopped, "Stopped")
+			return ctx.Err()
 		}
+	}
+}
 
+// paymentFailed ends the task when err is a payment that didn't go through.
+// Another attempt could charge the buyer again, so these are never retried.
+func (inst *Instance) paymentFailed(err error) bool {
+	switch {
+	case errors.Is(err, ErrPaymentDeclined):
+		inst.setStatus(StateDeclined, err.Error())
+	case errors.Is(err, ErrThreeDSecure):
+		inst.setStatus(StateError, err.Error())
+	default:
+		return false
 	}
+	inst.clearCheckpoint()
+	return true
 }
 
-func Test() {
-	//bd-eu.porterproxies.com:8888::4p61al0m
-	//bd-eu.porterproxies.com:8888:user-PP_A46I34N-country-gb-plan-luminati-session-77201727:4p61al0m
-	//bd-eu.porterproxies.com:8888:user-PP_A46I34N-country-gb-plan-luminati-session-47144407:4p61al0m
-	//bd-eu.porterproxies.com:8888:user-PP_A46I34N-country-gb-plan-luminati-session-62726645:4p61al0m
-	//bd-eu.porterproxies.com:8888:user-PP_A46I34N-country-gb-plan-luminati-session-65273914:4p61al0m
-	//bd-eu.porterproxies.com:8888:user-PP_A46I34N-country-gb-plan-luminati-session-13220225:4p61al0m
-	//bd-eu.porterproxies.com:8888:user-PP_A46I34N-country-gb-plan-luminati-session-25219854:4p61al0m
-	//bd-eu.porterproxies.com:8888:user-PP_A46I34N-country-gb-plan-luminati-session-94389856:4p61al0m
-	//bd-eu.porterproxies.com:8888:user-PP_A46I34N-country-gb-plan-luminati-session-36275924:4p61al0m
-	//bd-eu.porterproxies.com:8888:user-PP_A46I34N-country-gb-plan-luminati-session-49296777:4p61al0m
-	//bd-eu.porterproxies.com:8888:user-PP_A46I34N-country-gb-plan-luminati-session-54498097:4p61al0m
-	prof := data_handling.Dylan()
-	opt := data_handling.Options{
-		TaskID:    0,
-		URL:       "https://releases.flatspot.com/products/nike-sb-x-albino-preto-dunk-low-pro-shoes-fossil-black-sail",
-		VariantID: "40747855872061",
-		UseProxy:  false,
-		Proxy: data_handling.ProxyDefiniton{
-			Protocol: "http",
-			Host:     "bd-eu.porterproxies.com",
-			Port:     "8888",
-			Username: "user-PP_A46I34N-country-gb-plan-luminati-session-31382305",
-			Password: "4p61al0m",
-		},
-		Profile: prof,
-		Size:    "UK 10",
-	}
-
-	inst, err := NewShopifyInstance(
-		opt,
-	)
+// recordHAR records every request the task makes, writing one HAR file per attempt to dir
+func (inst *Instance) recordHAR(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	inst.har = inst.Session.Record()
+	inst.harDir = dir
+	return nil
+}
 
-	if err != nil {
+func (inst *Instance) saveHAR(attempt int) {
+	if inst.har == nil {
+		return
+	}
+	name := fmt.Sprintf("task-%d-%s-%d.har", inst.TaskID, time.Now().Format("20060102-150405"), attempt)
+	if err := inst.har.Save(filepath.Join(inst.harDir, name)); err != nil {
+		inst.Logger.Error("Error saving HAR", zap.Error(err))
 	}
+}
 
-	inst.run()
-	fmt.Print("INST: %v", inst)
+// sleep waits for d, returning early if the task is stopped
+func (inst *Instance) sleep(d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-inst.ctx.Done():
+		return inst.ctx.Err()
+	}
 }
 
 type fn func()
 
 // Creates wrapper function and sets it to the passed pointer to function
 func (inst *Instance) wrap(function func() (bool, error)) (bool, error) {
-	fmt.Println(inst.Status)
+	inst.printStatus(inst.Status().String())
 	return function()
 }
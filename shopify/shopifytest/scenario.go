@@ -0,0 +1,122 @@
+package shopifytest
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Markup the checkout steps scrape, for Scenario.MissingTokens
+const (
+	TokenProductVariants = "productVariants"
+	TokenCheckout        = "checkout_token"
+	TokenAuthenticity    = "authenticity_token"
+	TokenAuthorization   = "authorization_token"
+	TokenGateway         = "gateway"
+	TokenTotalPrice      = "total_price"
+)
+
+// Scenario scripts how the fake store misbehaves. The zero value is a store that
+// always works. Scenarios passed to NewServer together are combined.
+type Scenario struct {
+	Name            string
+	BurstPath       string   // Limits RateLimited and ServerErrors to paths starting with this, "" for every path
+	RateLimited     int      // Answer this many requests with 429 and a Retry-After header
+	RetryAfter      int      // Seconds sent in Retry-After, 1 when unset
+	ServerErrors    int      // Then answer this many requests with 503
+	OutOfStock      bool     // The variant sells out between carting and checkout
+	CardDeclined    bool     // Processing sends the buyer back to the payment step
+	ThreeDSecure    bool     // Processing redirects to a 3DS challenge on the bank's host
+	QueueAttempts   int      // POST /checkout is sent to the queue this many times before it gets through
+	PasswordPage    bool     // The storefront is locked behind /password
+	ProcessingPolls int      // Processing says "still processing" this many times before finishing
+	MissingTokens   []string // Token* markup left out of the pages
+}
+
+// Ready made scenarios, to pick from per test
+var (
+	HappyPath        = Scenario{Name: "happy path"}
+	RateLimitBurst   = Scenario{Name: "429 burst", RateLimited: 3}
+	ServerErrorBurst = Scenario{Name: "5xx burst", ServerErrors: 3}
+	OutOfStock       = Scenario{Name: "out of stock at checkout", OutOfStock: true}
+	CardDeclined     = Scenario{Name: "card declined", CardDeclined: true}
+	ThreeDSecure     = Scenario{Name: "3DS redirect", ThreeDSecure: true}
+	CheckoutQueue    = Scenario{Name: "checkout queue", QueueAttempts: 2}
+	PasswordPage     = Scenario{Name: "password page", PasswordPage: true}
+	SlowProcessing   = Scenario{Name: "slow processing", ProcessingPolls: 3}
+	MissingTokens    = Scenario{Name: "missing tokens", MissingTokens: []string{TokenAuthenticity}}
+)
+
+// Scenarios lists every ready made scenario, for table driven tests
+func Scenarios() []Scenario {
+	return []Scenario{
+		HappyPath, RateLimitBurst, ServerErrorBurst, OutOfStock, CardDeclined,
+		ThreeDSecure, CheckoutQueue, PasswordPage, SlowProcessing, MissingTokens,
+	}
+}
+
+// combine adds other's faults to s
+func (s Scenario) combine(other Scenario) Scenario {
+	if s.Name == "" {
+		s.Name = other.Name
+	} else if other.Name != "" {
+		s.Name += " + " + other.Name
+	}
+	if other.BurstPath != "" {
+		s.BurstPath = other.BurstPath
+	}
+	if other.RetryAfter != 0 {
+		s.RetryAfter = other.RetryAfter
+	}
+	s.RateLimited += other.RateLimited
+	s.ServerErrors += other.ServerErrors
+	s.OutOfStock = s.OutOfStock || other.OutOfStock
+	s.CardDeclined = s.CardDeclined || other.CardDeclined
+	s.ThreeDSecure = s.ThreeDSecure || other.ThreeDSecure
+	s.QueueAttempts += other.QueueAttempts
+	s.PasswordPage = s.PasswordPage || other.PasswordPage
+	s.ProcessingPolls += other.ProcessingPolls
+	s.MissingTokens = append(append([]string(nil), s.MissingTokens...), other.MissingTokens...)
+	return s
+}
+
+func (s Scenario) missing(token string) bool {
+	for _, t := range s.MissingTokens {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
+
+// injectFault answers the request with the scenario's next burst fault or the
+// password page, returning false when the request should be served normally
+func (s *Server) injectFault(w http.ResponseWriter, r *http.Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if strings.HasPrefix(r.URL.Path, s.Scenario.BurstPath) {
+		switch {
+		case s.rateLimited < s.Scenario.RateLimited:
+			s.rateLimited++
+			retryAfter := s.Scenario.RetryAfter
+			if retryAfter == 0 {
+				retryAfter = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return true
+		case s.serverErrors < s.Scenario.ServerErrors:
+			s.serverErrors++
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return true
+		}
+	}
+
+	// Deposit sessions are on Shopify's card vault, which the password doesn't cover
+	if s.Scenario.PasswordPage && r.URL.Path != "/password" && r.URL.Path != "/sessions" {
+		http.Redirect(w, r, s.url(r, "/password"), http.StatusFound)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,681 @@
+// Package shopifytest runs a fake Shopify storefront on a local httptest server, so a
+// whole checkout can run end to end without the network.
+//
+//	srv := shopifytest.NewServer()
+//	defer srv.Close()
+//	inst, err := srv.NewInstance(data_handling.Options{Size: "UK 9", Profile: shopifytest.Profile()})
+//	err = inst.Run(ctx)
+//	orders := srv.Orders()
+package shopifytest
+
+import (
+	"alin/packages/session"
+	"alin/packages/shopify"
+	"alin/packages/shopify/data_handling"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type Variant struct {
+	ID        string
+	Title     string // Size, e.g. "UK 9"
+	Available bool
+}
+
+type Product struct {
+	Handle   string
+	Title    string
+	Price    int // Pence
+	Variants []Variant
+}
+
+// Order is a checkout that reached thank_you
+type Order struct {
+	CheckoutToken  string
+	VariantID      string // The first variant in the cart
+	Quantity       int    // Items ordered, across every variant
+	ShippingRateID string
+	Email          string
+	CardLastFour   string
+	TotalPrice     int // Pence, including shipping
+}
+
+// Server is a fake store. Its fields can be changed before the first request.
+type Server struct {
+	*httptest.Server
+	Store         shopify.ShopifyStore
+	Product       Product
+	ShippingRates []shopify.ShippingRate
+	Gateway       string
+	Scenario      Scenario
+
+	mu           sync.Mutex
+	carts        map[string][]cartLine // By cart cookie
+	checkouts    map[string]*checkout
+	sessions     map[string]data_handling.CardDetails // Deposit session ID to card
+	orders       []Order
+	hits         map[string]int // Requests by path
+	rateLimited  int
+	serverErrors int
+	queued       int
+}
+
+// checkout tracks one checkout through the steps, so out of order or
+// badly tokened requests are rejected like the real thing would
+type checkout struct {
+	token              string
+	cart               string // Cart cookie, emptied once the order is placed
+	lines              []cartLine
+	authenticityToken  string // Rotated on every page load, as Shopify does
+	authorizationToken string
+	email              string
+	shippingRateID     string
+	card               data_handling.CardDetails
+	processing         bool
+	polls              int // Processing page loads so far
+}
+
+// cartLine is a variant in a cart and how many of it
+type cartLine struct {
+	variantID string
+	quantity  int
+}
+
+var serverCount int32
+
+// NewServer starts a fake store and registers it, each server under its own domain.
+// The scenarios are combined to script how it misbehaves.
+func NewServer(scenarios ...Scenario) *Server {
+	n := atomic.AddInt32(&serverCount, 1)
+	s := &Server{
+		Store: shopify.ShopifyStore{
+			Domain:         fmt.Sprintf("shop%d.shopifytest.local", n),
+			Code:           "1000000" + strconv.Itoa(int(n)),
+			CheckoutDomain: fmt.Sprintf("checkout%d.shopifytest.local", n),
+			DepositDomain:  fmt.Sprintf("deposit%d.shopifytest.local/sessions", n),
+		},
+		Product: Product{
+			Handle: "dunk-low-pro",
+			Title:  "Dunk Low Pro",
+			Price:  4995,
+			Variants: []Variant{
+				{ID: "40000000000001", Title: "UK 8", Available: true},
+				{ID: "40000000000002", Title: "UK 9", Available: true},
+				{ID: "40000000000003", Title: "UK 10", Available: true},
+			},
+		},
+		ShippingRates: []shopify.ShippingRate{
+			shippingRate("Store Pickup + Delivery-standard-3-5-working-days-3.99", "3.99", "Standard 3 - 5 Working Days"),
+			shippingRate("Store Pickup + Delivery-next-working-day-5.99", "5.99", "Next Working Day."),
+			shippingRate("Store Pickup + Delivery-saturday-delivery-9.99", "9.99", "Saturday Delivery"),
+		},
+		Gateway:   "12345678",
+		carts:     map[string][]cartLine{},
+		checkouts: map[string]*checkout{},
+		sessions:  map[string]data_handling.CardDetails{},
+		hits:      map[string]int{},
+	}
+	for _, scenario := range scenarios {
+		s.Scenario = s.Scenario.combine(scenario)
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	shopify.RegisterStore(s.Store)
+	return s
+}
+
+func shippingRate(id, price, title string) shopify.ShippingRate {
+	return shopify.ShippingRate{ID: id, Price: price, Title: title, DeliveryRange: []any{}}
+}
+
+// Transport sends requests for any host to the server, trusting its certificate
+func (s *Server) Transport() *http.Transport {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+	addr := s.Listener.Addr().String()
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+		// httptest's certificate is issued for example.com
+		TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "example.com"},
+	}
+}
+
+// Attach points the session at the server
+func (s *Server) Attach(sess *session.Session) {
+	sess.SetTransport(s.Transport())
+}
+
+// ProductURL is the product page on the fake store
+func (s *Server) ProductURL() string {
+	return fmt.Sprintf("https://%s/products/%s", s.Store.Domain, s.Product.Handle)
+}
+
+// NewInstance creates an Instance for the fake store's product, attached to the server.
+// options.URL defaults to ProductURL.
+func (s *Server) NewInstance(options data_handling.Options) (*shopify.Instance, error) {
+	if options.URL == "" {
+		options.URL = s.ProductURL()
+	}
+	inst, err := shopify.NewShopifyInstance(options, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.Attach(inst.Session)
+	return inst, nil
+}
+
+// Orders returns the checkouts that have completed
+func (s *Server) Orders() []Order {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Order(nil), s.orders...)
+}
+
+// Hits is the number of requests made for path, whatever the method
+func (s *Server) Hits(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits[path]
+}
+
+// Profile is a valid profile with a test card
+func Profile() data_handling.CheckoutProfile {
+	return data_handling.CheckoutProfile{
+		Name:     "Test",
+		Email:    "test@example.com",
+		Country:  "United Kingdom",
+		Fname:    "Test",
+		Lname:    "Buyer",
+		Address1: "1 High Street",
+		City:     "London",
+		Zipcode:  "SW1A 1AA",
+		Phone:    "7700900123",
+		Card: data_handling.CardDetails{
+			Number:            "4242 4242 4242 4242",
+			Name:              "TEST BUYER",
+			Month:             "12",
+			Year:              "2099",
+			VerificationValue: "123",
+		},
+	}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.hits[r.URL.Path]++
+	s.mu.Unlock()
+	if s.injectFault(w, r) {
+		return
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	checkoutPrefix := fmt.Sprintf("/%s/checkouts/", s.Store.Code)
+
+	switch {
+	case r.Method == http.MethodHead || path == "":
+		w.WriteHeader(http.StatusOK)
+	case path == "/password":
+		htmlPage(w, http.StatusOK, "<h1>Opening soon</h1><form action=\"/password\" method=\"post\"><input type=\"password\" name=\"password\"></form>")
+	case path == "/throttle/queue":
+		htmlPage(w, http.StatusOK, "<h1>You're in line to check out</h1>")
+	case strings.HasPrefix(path, "/challenge/"):
+		htmlPage(w, http.StatusOK, "<h1>Confirm this payment with your bank</h1>")
+	case r.Method == http.MethodGet && path == "/products/"+s.Product.Handle:
+		s.productPage(w, r)
+	case r.Method == http.MethodPost && path == "/cart/add.js":
+		s.addToCart(w, r)
+	case r.Method == http.MethodPost && path == "/cart/clear.js":
+		s.clearCart(w, r)
+	case r.Method == http.MethodPost && path == "/checkout":
+		s.createCheckout(w, r)
+	case r.Method == http.MethodPost && path == "/sessions":
+		s.depositSession(w, r)
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/api/checkouts/") && strings.HasSuffix(path, "/shipping_rates.json"):
+		s.shippingRates(w, r, strings.TrimSuffix(strings.TrimPrefix(path, "/api/checkouts/"), "/shipping_rates.json"))
+	case strings.HasPrefix(path, checkoutPrefix):
+		parts := strings.SplitN(strings.TrimPrefix(path, checkoutPrefix), "/", 2)
+		page := ""
+		if len(parts) == 2 {
+			page = parts[1]
+		}
+		s.checkoutPage(w, r, parts[0], page)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) productPage(w http.ResponseWriter, r *http.Request) {
+	type variantJSON struct {
+		ID    string `json:"id"`
+		Title string `json:"title"`
+		Price struct {
+			Amount       float64 `json:"amount"`
+			CurrencyCode string  `json:"currencyCode"`
+		} `json:"price"`
+		Product struct {
+			ID    string `json:"id"`
+			Title string `json:"title"`
+		} `json:"product"`
+	}
+	variants := make([]variantJSON, len(s.Product.Variants))
+	for i, v := range s.Product.Variants {
+		variants[i].ID = v.ID
+		variants[i].Title = v.Title
+		variants[i].Price.Amount = float64(s.Product.Price) / 100
+		variants[i].Price.CurrencyCode = "GBP"
+		variants[i].Product.ID = "7000000000001"
+		variants[i].Product.Title = s.Product.Title
+	}
+	data, _ := json.Marshal(variants)
+	meta := fmt.Sprintf(`{"productVariants":%s}`, data)
+	if s.scenario().missing(TokenProductVariants) {
+		meta = "{}"
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!doctype html>
+<html><head><title>%s</title>
+<script>window.ShopifyAnalytics.meta = %s;</script>
+</head><body><h1>%s</h1></body></html>`, s.Product.Title, meta, s.Product.Title)
+}
+
+func (s *Server) scenario() Scenario {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Scenario
+}
+
+func (s *Server) variant(id string) (Variant, bool) {
+	for _, v := range s.Product.Variants {
+		if v.ID == id {
+			return v, true
+		}
+	}
+	return Variant{}, false
+}
+
+func (s *Server) addToCart(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Quantity int    `json:"quantity"`
+		ID       string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		jsonError(w, http.StatusBadRequest, "Bad Request", "Could not read request")
+		return
+	}
+	variant, ok := s.variant(payload.ID)
+	if !ok {
+		jsonError(w, http.StatusNotFound, "Not Found", "Cannot find variant")
+		return
+	}
+	if !variant.Available {
+		jsonError(w, http.StatusUnprocessableEntity, "Cannot add this item to your cart", "The product '"+s.Product.Title+"' is already sold out.")
+		return
+	}
+
+	if payload.Quantity < 1 {
+		payload.Quantity = 1
+	}
+
+	// Like Shopify, adding to a cart adds to the quantity already there
+	s.mu.Lock()
+	cart := ""
+	if cookie, err := r.Cookie("cart"); err == nil {
+		if _, ok := s.carts[cookie.Value]; ok {
+			cart = cookie.Value
+		}
+	}
+	if cart == "" {
+		cart = randomToken(16)
+		s.carts[cart] = nil
+	}
+	lines := s.carts[cart]
+	quantity := payload.Quantity
+	found := false
+	for i := range lines {
+		if lines[i].variantID == variant.ID {
+			lines[i].quantity += payload.Quantity
+			quantity = lines[i].quantity
+			found = true
+		}
+	}
+	if !found {
+		lines = append(lines, cartLine{variantID: variant.ID, quantity: quantity})
+	}
+	s.carts[cart] = lines
+	s.mu.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: "cart", Value: cart, Path: "/"})
+
+	id, _ := strconv.ParseInt(variant.ID, 10, 64)
+	writeJSON(w, http.StatusOK, shopify.Cart{
+		Id:           id,
+		Quantity:     quantity,
+		VariantId:    id,
+		Key:          variant.ID + ":" + cart,
+		Title:        s.Product.Title + " - " + variant.Title,
+		Price:        s.Product.Price,
+		LinePrice:    s.Product.Price * quantity,
+		FinalPrice:   s.Product.Price,
+		Handle:       s.Product.Handle,
+		ProductTitle: s.Product.Title,
+		VariantTitle: variant.Title,
+	})
+}
+
+// clearCart empties the buyer's cart
+func (s *Server) clearCart(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie("cart"); err == nil {
+		s.mu.Lock()
+		if _, ok := s.carts[cookie.Value]; ok {
+			s.carts[cookie.Value] = nil
+		}
+		s.mu.Unlock()
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"item_count": 0, "items": []any{}})
+}
+
+func (s *Server) createCheckout(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cart := ""
+	if cookie, err := r.Cookie("cart"); err == nil {
+		cart = cookie.Value
+	}
+	lines := s.carts[cart]
+	if len(lines) == 0 {
+		// An empty cart sends you back to it
+		http.Redirect(w, r, s.url(r, "/cart"), http.StatusFound)
+		return
+	}
+
+	if s.queued < s.Scenario.QueueAttempts {
+		s.queued++
+		http.Redirect(w, r, s.url(r, "/throttle/queue?_ctd="+randomToken(8)), http.StatusFound)
+		return
+	}
+
+	c := &checkout{
+		token:              randomToken(16),
+		cart:               cart,
+		lines:              append([]cartLine(nil), lines...),
+		authorizationToken: randomToken(20),
+	}
+	s.checkouts[c.token] = c
+	if s.Scenario.OutOfStock {
+		http.Redirect(w, r, s.url(r, s.checkoutPath(c.token, "stock_problems")), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, s.url(r, s.checkoutPath(c.token, "")), http.StatusFound)
+}
+
+func (s *Server) checkoutPage(w http.ResponseWriter, r *http.Request, token, page string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.checkouts[token]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case page == "processing":
+		s.processingLocked(w, r, c)
+	case page == "stock_problems":
+		htmlPage(w, http.StatusOK, "<h1>Some items are no longer available</h1><p>"+s.Product.Title+" is sold out.</p>")
+	case page == "thank_you":
+		htmlPage(w, http.StatusOK, "<h1>Thank you for your purchase!</h1>")
+	case page != "":
+		http.NotFound(w, r)
+	case r.Method == http.MethodGet && c.processing:
+		// A checkout waiting on its payment only shows the processing page
+		http.Redirect(w, r, s.url(r, s.checkoutPath(c.token, "processing")), http.StatusFound)
+	case r.Method == http.MethodGet:
+		s.stepPage(w, r, c)
+	case r.Method == http.MethodPost:
+		s.submitStep(w, r, c)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// processingLocked finishes the payment once the scenario's polls are used up
+func (s *Server) processingLocked(w http.ResponseWriter, r *http.Request, c *checkout) {
+	if !c.processing {
+		http.Redirect(w, r, s.url(r, s.checkoutPath(c.token, "")), http.StatusFound)
+		return
+	}
+	if c.polls < s.Scenario.ProcessingPolls {
+		c.polls++
+		htmlPage(w, http.StatusOK, "<h1>Your order's being processed</h1>")
+		return
+	}
+
+	c.processing = false
+	switch {
+	case s.Scenario.CardDeclined:
+		http.Redirect(w, r, s.url(r, s.checkoutPath(c.token, "")+"?previous_step=payment_method&step=payment_method"), http.StatusFound)
+	case s.Scenario.ThreeDSecure:
+		http.Redirect(w, r, "https://acs."+s.Store.Domain+"/challenge/"+randomToken(8), http.StatusFound)
+	default:
+		s.completeLocked(c)
+		http.Redirect(w, r, s.url(r, s.checkoutPath(c.token, "thank_you")), http.StatusFound)
+	}
+}
+
+// stepPage renders the page for ?step=, with the markup the checkout steps scrape
+func (s *Server) stepPage(w http.ResponseWriter, r *http.Request, c *checkout) {
+	c.authenticityToken = randomToken(24)
+	missing := s.Scenario.missing
+
+	var head, body string
+	if !missing(TokenCheckout) {
+		head += fmt.Sprintf("<script>Shopify.Checkout.token = \"%s\";</script>\n", c.token)
+	}
+	if !missing(TokenAuthenticity) {
+		body += fmt.Sprintf("<input type=\"hidden\" name=\"authenticity_token\" value=\"%s\" />\n", c.authenticityToken)
+	}
+
+	switch r.URL.Query().Get("step") {
+	case "shipping_method":
+		if !missing(TokenAuthorization) {
+			head += fmt.Sprintf("<meta name=\"shopify-checkout-authorization-token\" content=\"%s\">\n", c.authorizationToken)
+		}
+	case "payment_method":
+		if c.shippingRateID == "" {
+			http.Redirect(w, r, s.url(r, s.checkoutPath(c.token, "")+"?step=shipping_method"), http.StatusFound)
+			return
+		}
+		if !missing(TokenTotalPrice) {
+			head += fmt.Sprintf("<script>Shopify.Checkout.totalPrice = %.2f;</script>\n", float64(s.totalLocked(c))/100)
+		}
+		if !missing(TokenGateway) {
+			body += fmt.Sprintf("<div data-select-gateway=\"%s\">\n", s.Gateway)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!doctype html>
+<html><head>
+%s</head><body>
+<form method="post" action="%s">
+%s</form>
+</body></html>`, head, s.checkoutPath(c.token, ""), body)
+}
+
+func (s *Server) submitStep(w http.ResponseWriter, r *http.Request, c *checkout) {
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if c.authenticityToken == "" || r.PostForm.Get("authenticity_token") != c.authenticityToken {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, "Invalid authenticity token")
+		return
+	}
+	// Every token is good for one submission
+	c.authenticityToken = ""
+
+	next := s.checkoutPath(c.token, "")
+	switch r.PostForm.Get("previous_step") {
+	case "contact_information":
+		c.email = r.PostForm.Get("checkout[email_or_phone]")
+		next += "?previous_step=contact_information&step=shipping_method"
+	case "shipping_method":
+		rateID := r.PostForm.Get("checkout[shipping_rate][id]")
+		if _, ok := s.rateLocked(rateID); !ok {
+			next += "?step=shipping_method"
+			break
+		}
+		c.shippingRateID = rateID
+		next += "?previous_step=shipping_method&step=payment_method"
+	case "payment_method":
+		card, ok := s.sessions[r.PostForm.Get("s")]
+		total, _ := strconv.Atoi(r.PostForm.Get("checkout[total_price]"))
+		if !ok || c.shippingRateID == "" || r.PostForm.Get("checkout[payment_gateway]") != s.Gateway || total != s.totalLocked(c) {
+			next += "?step=payment_method"
+			break
+		}
+		c.card = card
+		c.processing = true
+		next = s.checkoutPath(c.token, "processing")
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, s.url(r, next), http.StatusFound)
+}
+
+func (s *Server) shippingRates(w http.ResponseWriter, r *http.Request, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.checkouts[token]
+	if !ok {
+		jsonError(w, http.StatusNotFound, "Not Found", "Checkout not found")
+		return
+	}
+	if r.Header.Get("X-Shopify-Checkout-Authorization-Token") != c.authorizationToken {
+		jsonError(w, http.StatusUnauthorized, "Unauthorized", "Invalid authorization token")
+		return
+	}
+
+	rates := make([]shopify.ShippingRate, len(s.ShippingRates))
+	for i, rate := range s.ShippingRates {
+		price, _ := strconv.ParseFloat(rate.Price, 64)
+		rate.Checkout.SubtotalPrice = fmt.Sprintf("%.2f", float64(s.Product.Price)/100)
+		rate.Checkout.TotalPrice = fmt.Sprintf("%.2f", float64(s.Product.Price)/100+price)
+		rates[i] = rate
+	}
+	writeJSON(w, http.StatusOK, shopify.ShippingRates{ShippingRate: rates})
+}
+
+func (s *Server) depositSession(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		CreditCard data_handling.CardDetails `json:"credit_card"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.CreditCard.Validate() != nil {
+		jsonError(w, http.StatusBadRequest, "Bad Request", "Invalid card")
+		return
+	}
+
+	id := "east-" + randomToken(16)
+	s.mu.Lock()
+	s.sessions[id] = payload.CreditCard
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]string{"id": id})
+}
+
+func (s *Server) completeLocked(c *checkout) {
+	number := strings.ReplaceAll(c.card.Number, " ", "")
+	if len(number) > 4 {
+		number = number[len(number)-4:]
+	}
+	quantity := 0
+	for _, line := range c.lines {
+		quantity += line.quantity
+	}
+	s.orders = append(s.orders, Order{
+		CheckoutToken:  c.token,
+		VariantID:      c.lines[0].variantID,
+		Quantity:       quantity,
+		ShippingRateID: c.shippingRateID,
+		Email:          c.email,
+		CardLastFour:   number,
+		TotalPrice:     s.totalLocked(c),
+	})
+	// The checkout is done with, later requests for it 404, and the cart is emptied
+	delete(s.checkouts, c.token)
+	delete(s.carts, c.cart)
+}
+
+func (s *Server) rateLocked(id string) (shopify.ShippingRate, bool) {
+	for _, rate := range s.ShippingRates {
+		if rate.ID == id {
+			return rate, true
+		}
+	}
+	return shopify.ShippingRate{}, false
+}
+
+// totalLocked is the cart plus the chosen shipping, in pence
+func (s *Server) totalLocked(c *checkout) int {
+	total := 0
+	for _, line := range c.lines {
+		total += s.Product.Price * line.quantity
+	}
+	if rate, ok := s.rateLocked(c.shippingRateID); ok {
+		price, _ := strconv.ParseFloat(rate.Price, 64)
+		total += int(price*100 + 0.5)
+	}
+	return total
+}
+
+func (s *Server) checkoutPath(token, page string) string {
+	path := fmt.Sprintf("/%s/checkouts/%s", s.Store.Code, token)
+	if page != "" {
+		path += "/" + page
+	}
+	return path
+}
+
+// url makes an absolute URL on the host the request was sent to, as Shopify's redirects are
+func (s *Server) url(r *http.Request, path string) string {
+	return "https://" + r.Host + path
+}
+
+func htmlPage(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<!doctype html>\n<html><body>%s</body></html>", body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func jsonError(w http.ResponseWriter, status int, message, description string) {
+	writeJSON(w, status, map[string]interface{}{"status": status, "message": message, "description": description})
+}
+
+func randomToken(bytes int) string {
+	b := make([]byte, bytes)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
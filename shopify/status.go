@@ -0,0 +1,151 @@
+package shopify
+
+import (
+	"alin/packages/session"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type TaskState int
+
+const (
+	StateIdle TaskState = iota
+	StateMonitoring
+	StateCarting
+	StateCheckout
+	StateProcessing
+	StateSuccess
+	StateDeclined
+	StateError
+	StateStopped
+)
+
+var taskStateNames = map[TaskState]string{
+	StateIdle:       "Idle",
+	StateMonitoring: "Monitoring",
+	StateCarting:    "Carting",
+	StateCheckout:   "Checkout",
+	StateProcessing: "Processing",
+	StateSuccess:    "Success",
+	StateDeclined:   "Declined",
+	StateError:      "Error",
+	StateStopped:    "Stopped",
+}
+
+func (s TaskState) String() string {
+	if name, ok := taskStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("TaskState(%d)", int(s))
+}
+
+// MarshalText lets the UI receive states by name rather than number
+func (s TaskState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *TaskState) UnmarshalText(text []byte) error {
+	for state, name := range taskStateNames {
+		if name == string(text) {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown task state %q", string(text))
+}
+
+// Status is a task state with a human readable message, stamped when it was entered
+type Status struct {
+	State   TaskState `json:"state"`
+	Message string    `json:"message"`
+	At      time.Time `json:"at"`
+}
+
+func (s Status) String() string {
+	if s.Message == "" {
+		return s.State.String()
+	}
+	return fmt.Sprintf("%s: %s", s.State, s.Message)
+}
+
+// Keeps a retrying task from growing its history forever
+const maxStatusHistory = 200
+
+// statusTracker guards the current status, which is written by the task
+// goroutine and read by the UI
+type statusTracker struct {
+	mu      sync.RWMutex
+	current Status
+	history []Status
+}
+
+func (t *statusTracker) set(state TaskState, message string) Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.current = Status{State: state, Message: message, At: time.Now()}
+	t.history = append(t.history, t.current)
+	if len(t.history) > maxStatusHistory {
+		t.history = t.history[len(t.history)-maxStatusHistory:]
+	}
+	return t.current
+}
+
+func (t *statusTracker) get() Status {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.current
+}
+
+func (t *statusTracker) list() []Status {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	history := make([]Status, len(t.history))
+	copy(history, t.history)
+	return history
+}
+
+// Status returns the task's current status. Safe to call from any goroutine.
+func (inst *Instance) Status() Status {
+	return inst.status.get()
+}
+
+// StatusHistory returns every transition the task has made, oldest first
+func (inst *Instance) StatusHistory() []Status {
+	return inst.status.list()
+}
+
+// Shorter waits on the store's rate limit aren't worth showing
+const limiterStatusThreshold = 250 * time.Millisecond
+
+// limiterWait notes a long wait on the store's rate limit in the current status
+func (inst *Instance) limiterWait(host string, wait time.Duration) {
+	if wait < limiterStatusThreshold {
+		return
+	}
+	current := inst.status.get()
+	message := fmt.Sprintf("Waiting %s on %s rate limit", wait.Round(time.Millisecond), host)
+	// Replace the note from an earlier wait in the same step rather than adding to it
+	step := current.Message
+	if i := strings.Index(step, " (Waiting "); i >= 0 {
+		step = step[:i]
+	}
+	if step != "" {
+		message = step + " (" + message + ")"
+	}
+	inst.setStatus(current.State, message)
+}
+
+func (inst *Instance) setStatus(state TaskState, message string) {
+	// Messages are shown in the UI and kept in history, so they get the same redaction as logs
+	message = session.Redact(message)
+	previous := inst.status.get()
+	current := inst.status.set(state, message)
+	if previous.State != current.State {
+		inst.Logger.Info("Status changed", zap.Stringer("From", previous.State), zap.Stringer("To", current.State), zap.String("Message", message))
+	}
+}
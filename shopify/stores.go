@@ -0,0 +1,62 @@
+package shopify
+
+import (
+	"alin/packages/session"
+	"strings"
+	"sync"
+)
+
+// Budget for the built in stores, well under what trips Shopify's bot protection
+const (
+	defaultRateLimit = 4
+	defaultRateBurst = 8
+)
+
+var (
+	storesMu sync.RWMutex
+	stores   = map[string]ShopifyStore{}
+)
+
+func init() {
+	RegisterStore(ShopifyStore{
+		Domain:         "launches.routeone.co.uk",
+		Code:           "50487623851",
+		CheckoutDomain: "checkout.shopifycs.com",
+		DepositDomain:  "deposit.us.shopifycs.com/sessions",
+		RateLimit:      defaultRateLimit,
+		RateBurst:      defaultRateBurst,
+	})
+	RegisterStore(ShopifyStore{
+		Domain:         "www.routeone.co.uk",
+		Code:           "27442937933",
+		CheckoutDomain: "checkout.shopifycs.com",
+		DepositDomain:  "deposit.us.shopifycs.com/sessions",
+		RateLimit:      defaultRateLimit,
+		RateBurst:      defaultRateBurst,
+	})
+	RegisterStore(ShopifyStore{
+		Domain:         "releases.flatspot.com",
+		Code:           "2744451133",
+		CheckoutDomain: "checkout.shopifycs.com",
+		DepositDomain:  "deposit.us.shopifycs.com/sessions",
+		RateLimit:      defaultRateLimit,
+		RateBurst:      defaultRateBurst,
+	})
+}
+
+// RegisterStore adds a store to the registry, replacing any store with the same domain,
+// and sets the request budget every task shares for it
+func RegisterStore(store ShopifyStore) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	stores[strings.ToLower(store.Domain)] = store
+	session.SetHostLimit(store.Domain, session.HostLimit{Rate: store.RateLimit, Burst: store.RateBurst})
+}
+
+// LookupStore finds a registered store by its hostname (without port)
+func LookupStore(domain string) (ShopifyStore, bool) {
+	storesMu.RLock()
+	defer storesMu.RUnlock()
+	store, ok := stores[strings.ToLower(domain)]
+	return store, ok
+}
@@ -0,0 +1,248 @@
+package shopify
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.uber.org/multierr"
+)
+
+var ErrGroupNotFound = errors.New("Task group not found")
+
+// TaskGroup bundles the tasks for one release, e.g. "Dunk Low Pro – Saturday"
+type TaskGroup struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	TaskIDs []int  `json:"taskIds"`
+}
+
+// GroupEdit changes shared fields on every task in a group. Nil fields are left alone.
+type GroupEdit struct {
+	URL     *string    `json:"url"`
+	Sizes   []string   `json:"sizes"` // Handed out to the group's tasks in order, repeating as needed
+	StartAt *time.Time `json:"startAt"`
+}
+
+// CreateGroup adds an empty group and returns its ID
+func (m *TaskManager) CreateGroup(name string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if name == "" {
+		return 0, errors.New("Group name is required")
+	}
+	id := m.nextGroupID
+	m.groups[id] = &TaskGroup{ID: id, Name: name}
+	m.nextGroupID++
+	m.saveLocked()
+	return id, nil
+}
+
+// AddToGroup moves tasks into a group, taking them out of any group they were in
+func (m *TaskManager) AddToGroup(groupID int, taskIDs ...int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	group, ok := m.groups[groupID]
+	if !ok {
+		return ErrGroupNotFound
+	}
+	for _, id := range taskIDs {
+		if _, ok := m.tasks[id]; !ok {
+			return fmt.Errorf("Task %d: %w", id, ErrTaskNotFound)
+		}
+	}
+
+	for _, id := range taskIDs {
+		m.ungroupLocked(id)
+		group.TaskIDs = append(group.TaskIDs, id)
+	}
+	sort.Ints(group.TaskIDs)
+	m.saveLocked()
+	return nil
+}
+
+// RemoveFromGroup takes tasks out of their group without deleting them
+func (m *TaskManager) RemoveFromGroup(taskIDs ...int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range taskIDs {
+		m.ungroupLocked(id)
+	}
+	m.saveLocked()
+}
+
+func (m *TaskManager) ungroupLocked(taskID int) {
+	for _, group := range m.groups {
+		for i, id := range group.TaskIDs {
+			if id == taskID {
+				group.TaskIDs = append(group.TaskIDs[:i], group.TaskIDs[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Groups returns every group, ordered by ID
+func (m *TaskManager) Groups() []TaskGroup {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	groups := make([]TaskGroup, 0, len(m.groups))
+	for _, group := range m.groups {
+		groups = append(groups, group.copy())
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].ID < groups[j].ID
+	})
+	return groups
+}
+
+func (g *TaskGroup) copy() TaskGroup {
+	c := *g
+	c.TaskIDs = append([]int(nil), g.TaskIDs...)
+	return c
+}
+
+func (m *TaskManager) groupTaskIDs(groupID int) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	group, ok := m.groups[groupID]
+	if !ok {
+		return nil, ErrGroupNotFound
+	}
+	return append([]int(nil), group.TaskIDs...), nil
+}
+
+// StartGroup starts every task in the group that is not already running
+func (m *TaskManager) StartGroup(groupID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	group, ok := m.groups[groupID]
+	if !ok {
+		return ErrGroupNotFound
+	}
+
+	var err error
+	for _, id := range group.TaskIDs {
+		if startErr := m.startLocked(id); startErr != nil && !errors.Is(startErr, ErrTaskRunning) {
+			err = multierr.Append(err, fmt.Errorf("Task %d: %w", id, startErr))
+		}
+	}
+	return err
+}
+
+// StopGroup cancels every task in the group without waiting for them to exit
+func (m *TaskManager) StopGroup(groupID int) error {
+	ids, err := m.groupTaskIDs(groupID)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		m.Stop(id)
+	}
+	return nil
+}
+
+// DeleteGroup stops and deletes every task in the group, then the group itself
+func (m *TaskManager) DeleteGroup(groupID int) error {
+	ids, err := m.groupTaskIDs(groupID)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if deleteErr := m.Delete(id); deleteErr != nil && !errors.Is(deleteErr, ErrTaskNotFound) {
+			err = multierr.Append(err, fmt.Errorf("Task %d: %w", id, deleteErr))
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.groups, groupID)
+	m.saveLocked()
+	return err
+}
+
+// CloneGroup copies the group and all of its tasks, returning the new group's ID
+func (m *TaskManager) CloneGroup(groupID int, name string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	group, ok := m.groups[groupID]
+	if !ok {
+		return 0, ErrGroupNotFound
+	}
+	if name == "" {
+		name = group.Name + " (copy)"
+	}
+
+	clone := &TaskGroup{ID: m.nextGroupID, Name: name}
+	for _, id := range group.TaskIDs {
+		task, ok := m.tasks[id]
+		if !ok {
+			continue
+		}
+		options := task.Options
+		options.TaskID = m.nextID
+		m.tasks[options.TaskID] = &Task{ID: options.TaskID, Options: options, store: task.store}
+		clone.TaskIDs = append(clone.TaskIDs, options.TaskID)
+		m.nextID++
+	}
+
+	m.groups[clone.ID] = clone
+	m.nextGroupID++
+	m.saveLocked()
+	return clone.ID, nil
+}
+
+// EditGroup applies the edit to every task in the group. Nothing changes unless
+// every edited task is still valid. Running tasks pick the change up when next started.
+func (m *TaskManager) EditGroup(groupID int, edit GroupEdit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	group, ok := m.groups[groupID]
+	if !ok {
+		return ErrGroupNotFound
+	}
+
+	var changes []*Task
+	for i, id := range group.TaskIDs {
+		task, ok := m.tasks[id]
+		if !ok {
+			continue
+		}
+
+		options := task.Options
+		if edit.URL != nil {
+			options.URL = *edit.URL
+			// A variant ID belongs to the old product
+			options.VariantID = ""
+		}
+		if len(edit.Sizes) > 0 {
+			options.Size = edit.Sizes[i%len(edit.Sizes)]
+		}
+		if edit.StartAt != nil {
+			options.StartAt = *edit.StartAt
+		}
+
+		edited, err := m.newTask(options)
+		if err != nil {
+			return fmt.Errorf("Task %d: %w", id, err)
+		}
+		changes = append(changes, edited)
+	}
+
+	for _, edited := range changes {
+		task := m.tasks[edited.ID]
+		task.Options = edited.Options
+		task.store = edited.store
+	}
+	m.saveLocked()
+	return nil
+}
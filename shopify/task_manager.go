@@ -0,0 +1,550 @@
+package shopify
+
+import (
+	"alin/packages/session"
+	"alin/packages/shopify/data_handling"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	ErrTaskNotFound   = errors.New("Task not found")
+	ErrTaskRunning    = errors.New("Task is already running")
+	ErrManagerStopped = errors.New("Task manager has shut down")
+	ErrInlineProfile  = errors.New("Saved tasks need a profile from the profile store, set ProfileName")
+)
+
+type TaskManagerConfig struct {
+	MaxConcurrent int                         // Tasks running at once across all stores, 0 for no limit
+	MaxPerStore   int                         // Tasks running at once against one store, 0 for no limit
+	Store         *TaskStore                  // Saves tasks and groups on every change, nil to keep them in memory
+	Profiles      data_handling.ProfileSource // Resolves Options.ProfileName, nil to use Options.Profile as given
+	Logging       session.LogConfig           // Zero value for session.DefaultLogConfig
+	Checkpoints   string                      // Directory to save checkout progress in, so restarted tasks resume. "" to not save it.
+	Middleware    []session.Middleware        // Added to every task's session, e.g. to watch or fake its requests
+}
+
+type Task struct {
+	ID       int
+	Options  data_handling.Options
+	store    string
+	instance *Instance // Nil until the task is first started
+	cancel   context.CancelFunc
+	done     chan struct{} // Closed when the task goroutine exits, nil if never started
+}
+
+func (t *Task) running() bool {
+	if t.done == nil {
+		return false
+	}
+	select {
+	case <-t.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// TaskInfo is a snapshot of a task for listing in the UI
+type TaskInfo struct {
+	ID         int       `json:"id"`
+	URL        string    `json:"url"`
+	Size       string    `json:"size"`
+	Store      string    `json:"store"`
+	Running    bool      `json:"running"`
+	Status     Status    `json:"status"`
+	StartAt    time.Time `json:"startAt"`    // Requested start on the store's clock
+	StartsInMs int64     `json:"startsInMs"` // Countdown to the corrected start, 0 once started
+	Retries    int64     `json:"retries"`    // Requests the task has sent again
+	LimitedMs  int64     `json:"limitedMs"`  // Time the task's requests have waited on the store's rate limit
+}
+
+// TaskManager runs many Instances concurrently, each in its own goroutine
+type TaskManager struct {
+	mu          sync.Mutex
+	config      TaskManagerConfig
+	tasks       map[int]*Task
+	nextID      int
+	groups      map[int]*TaskGroup
+	nextGroupID int                      // Group IDs are separate from task IDs
+	global      chan struct{}            // Semaphore for MaxConcurrent, nil when unlimited
+	stores      map[string]chan struct{} // Semaphores for MaxPerStore keyed by store domain
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+	logging     session.LogConfig
+	logger      *zap.Logger
+}
+
+// Constructor
+func NewTaskManager(config TaskManagerConfig) *TaskManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &TaskManager{
+		config:      config,
+		tasks:       map[int]*Task{},
+		nextID:      1,
+		groups:      map[int]*TaskGroup{},
+		nextGroupID: 1,
+		stores:      map[string]chan struct{}{},
+		ctx:         ctx,
+		cancel:      cancel,
+		logging:     session.DefaultLogConfig(),
+		logger:      session.NewLogger(),
+	}
+	if config.MaxConcurrent > 0 {
+		m.global = make(chan struct{}, config.MaxConcurrent)
+	}
+	if config.Logging != (session.LogConfig{}) {
+		if err := m.SetLogging(config.Logging); err != nil {
+			m.logger.Error("Invalid log config, using the default", zap.Error(err))
+		}
+	}
+	return m
+}
+
+// SetLogging replaces the log config. Running tasks keep logging the old way until restarted.
+func (m *TaskManager) SetLogging(config session.LogConfig) error {
+	logger, err := session.NewLoggerWithConfig(config)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.logging = config
+	m.logger = logger
+	return nil
+}
+
+// Create validates the options and adds an idle task, returning its ID
+func (m *TaskManager) Create(options data_handling.Options) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ctx.Err() != nil {
+		return 0, ErrManagerStopped
+	}
+
+	options.TaskID = m.nextID
+	task, err := m.newTask(options)
+	if err != nil {
+		return 0, err
+	}
+
+	m.tasks[task.ID] = task
+	m.nextID++
+	m.saveLocked()
+	return task.ID, nil
+}
+
+// newTask validates the options, including the profile they refer to
+func (m *TaskManager) newTask(options data_handling.Options) (*Task, error) {
+	// Task files only keep the profile's name, an inline profile would be gone after a restart
+	if m.config.Store != nil && (options.ProfileName == "" || m.config.Profiles == nil) {
+		return nil, ErrInlineProfile
+	}
+	inst, err := m.prepare(options, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Profiles with a name are looked up again on start rather than kept around
+	if options.ProfileName != "" && m.config.Profiles != nil {
+		options.Profile = data_handling.CheckoutProfile{}
+	}
+	return &Task{ID: options.TaskID, Options: options, store: inst.Store.Domain}, nil
+}
+
+// prepare resolves the task's profile and builds a fresh Instance
+func (m *TaskManager) prepare(options data_handling.Options, logger *zap.Logger) (*Instance, error) {
+	if options.ProfileName != "" && m.config.Profiles != nil {
+		profile, err := m.config.Profiles.Profile(options.ProfileName)
+		if err != nil {
+			return nil, err
+		}
+		options.Profile = profile
+	}
+	return NewShopifyInstance(options, logger)
+}
+
+// Start runs the task in its own goroutine. A finished task starts over with fresh state,
+// a stopped or crashed one carries on from its checkpoint if it has one.
+func (m *TaskManager) Start(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.startLocked(id)
+}
+
+func (m *TaskManager) startLocked(id int) error {
+	if m.ctx.Err() != nil {
+		return ErrManagerStopped
+	}
+
+	task, ok := m.tasks[id]
+	if !ok {
+		return ErrTaskNotFound
+	}
+	if task.running() {
+		return ErrTaskRunning
+	}
+
+	logger, closeLog, err := m.logging.TaskLogger(m.logger, id)
+	if err != nil {
+		return err
+	}
+
+	// Every run starts with fresh tokens, cart and cookies, unless it resumes from a checkpoint
+	inst, err := m.prepare(task.Options, logger)
+	if err != nil {
+		closeLog()
+		return err
+	}
+	if len(m.config.Middleware) > 0 {
+		inst.Session.Use(m.config.Middleware...)
+	}
+	if m.config.Checkpoints != "" {
+		if err := os.MkdirAll(m.config.Checkpoints, 0700); err != nil {
+			closeLog()
+			return err
+		}
+		inst.checkpointPath = checkpointFile(m.config.Checkpoints, id)
+	}
+	if m.logging.HARFiles {
+		if err := inst.recordHAR(m.logging.Dir); err != nil {
+			closeLog()
+			return err
+		}
+	}
+	task.instance = inst
+
+	ctx, cancel := context.WithCancel(m.ctx)
+	task.cancel = cancel
+	task.done = make(chan struct{})
+
+	m.wg.Add(1)
+	go m.runTask(ctx, task.instance, task.done, closeLog)
+	return nil
+}
+
+func (m *TaskManager) runTask(ctx context.Context, inst *Instance, done chan struct{}, closeLog func() error) {
+	defer m.wg.Done()
+	defer close(done)
+	defer closeLog()
+	defer func() {
+		if r := recover(); r != nil {
+			inst.Logger.Error("Task panicked", zap.Any("Panic", r), zap.String("Stack", string(debug.Stack())))
+			inst.setStatus(StateError, fmt.Sprintf("Crashed: %v", r))
+		}
+	}()
+
+	// Scheduled tasks don't hold a slot while they wait
+	if err := inst.waitForStart(ctx); err != nil {
+		inst.setStatus(StateStopped, "Stopped")
+		return
+	}
+
+	inst.setStatus(StateIdle, "Waiting for a free slot")
+	release, err := m.acquire(ctx, inst.Store.Domain)
+	if err != nil {
+		inst.setStatus(StateStopped, "Stopped")
+		return
+	}
+	defer release()
+
+	inst.Run(ctx)
+}
+
+// acquire takes a global slot and a slot for the store, blocking until both are free
+func (m *TaskManager) acquire(ctx context.Context, store string) (func(), error) {
+	if m.global != nil {
+		select {
+		case m.global <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	storeSem := m.storeSemaphore(store)
+	if storeSem != nil {
+		select {
+		case storeSem <- struct{}{}:
+		case <-ctx.Done():
+			if m.global != nil {
+				<-m.global
+			}
+			return nil, ctx.Err()
+		}
+	}
+
+	return func() {
+		if storeSem != nil {
+			<-storeSem
+		}
+		if m.global != nil {
+			<-m.global
+		}
+	}, nil
+}
+
+func (m *TaskManager) storeSemaphore(store string) chan struct{} {
+	if m.config.MaxPerStore <= 0 {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sem, ok := m.stores[store]
+	if !ok {
+		sem = make(chan struct{}, m.config.MaxPerStore)
+		m.stores[store] = sem
+	}
+	return sem
+}
+
+// Stop cancels a running task without waiting for it to exit
+func (m *TaskManager) Stop(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	task, ok := m.tasks[id]
+	if !ok {
+		return ErrTaskNotFound
+	}
+	if task.cancel != nil {
+		task.cancel()
+	}
+	return nil
+}
+
+// stopAndWait cancels the task and waits for its goroutine to exit. Must not hold m.mu.
+func (m *TaskManager) stopAndWait(id int) (*Task, error) {
+	m.mu.Lock()
+	task, ok := m.tasks[id]
+	if !ok {
+		m.mu.Unlock()
+		return nil, ErrTaskNotFound
+	}
+	if task.cancel != nil {
+		task.cancel()
+	}
+	done := task.done
+	m.mu.Unlock()
+
+	if done != nil {
+		<-done
+	}
+	return task, nil
+}
+
+// Restart stops the task, waits for it to exit and starts it again from scratch.
+// A task whose payment may have been sent keeps its checkpoint, so it waits on
+// that payment instead of paying a second time.
+func (m *TaskManager) Restart(id int) error {
+	if _, err := m.stopAndWait(id); err != nil {
+		return err
+	}
+	if m.paymentMayBeSent(id) {
+		m.logger.Info("Keeping checkpoint, the payment may have been sent", zap.Int("Task", id))
+	} else {
+		m.removeCheckpoint(id)
+	}
+	return m.Start(id)
+}
+
+// paymentMayBeSent reports whether the task's checkpoint is at or past the payment
+func (m *TaskManager) paymentMayBeSent(id int) bool {
+	if m.config.Checkpoints == "" {
+		return false
+	}
+	cp, err := LoadCheckpoint(checkpointFile(m.config.Checkpoints, id))
+	if err != nil || cp == nil {
+		return false
+	}
+	return cp.paymentMayBeSent()
+}
+
+// Delete stops the task and removes it, along with its group membership
+func (m *TaskManager) Delete(id int) error {
+	if _, err := m.stopAndWait(id); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tasks, id)
+	m.ungroupLocked(id)
+	m.saveLocked()
+	m.removeCheckpoint(id)
+	return nil
+}
+
+// removeCheckpoint throws away the task's saved progress so it next starts from scratch
+func (m *TaskManager) removeCheckpoint(id int) {
+	if m.config.Checkpoints == "" {
+		return
+	}
+	if err := os.Remove(checkpointFile(m.config.Checkpoints, id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		m.logger.Error("Error removing checkpoint", zap.Int("Task", id), zap.Error(err))
+	}
+}
+
+// Get returns a snapshot of one task
+func (m *TaskManager) Get(id int) (TaskInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	task, ok := m.tasks[id]
+	if !ok {
+		return TaskInfo{}, ErrTaskNotFound
+	}
+	return task.info(), nil
+}
+
+// List returns a snapshot of every task, ordered by ID
+func (m *TaskManager) List() []TaskInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	infos := make([]TaskInfo, 0, len(m.tasks))
+	for _, task := range m.tasks {
+		infos = append(infos, task.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// History returns every status transition of the task's current run
+func (m *TaskManager) History(id int) ([]Status, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	task, ok := m.tasks[id]
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+	if task.instance == nil {
+		return []Status{}, nil
+	}
+	return task.instance.StatusHistory(), nil
+}
+
+func (t *Task) info() TaskInfo {
+	info := TaskInfo{
+		ID:      t.ID,
+		URL:     t.Options.URL,
+		Size:    t.Options.Size,
+		Store:   t.store,
+		Running: t.running(),
+		Status:  Status{State: StateIdle},
+		StartAt: t.Options.StartAt,
+	}
+	if t.instance != nil {
+		info.URL = t.instance.URL
+		info.Status = t.instance.Status()
+		info.StartsInMs = t.instance.StartsIn().Milliseconds()
+		info.Retries = t.instance.Session.Retries()
+		info.LimitedMs = t.instance.Session.LimiterWait().Milliseconds()
+	}
+	return info
+}
+
+// Load replaces the manager's tasks and groups with those in the store. Profiles
+// are not looked up until a task starts, so a locked profile store is fine here.
+func (m *TaskManager) Load() error {
+	if m.config.Store == nil {
+		return nil
+	}
+	defs, groups, err := m.config.Store.Load()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, task := range m.tasks {
+		if task.running() {
+			return errors.New("Cannot load tasks while tasks are running")
+		}
+	}
+
+	m.tasks = map[int]*Task{}
+	m.groups = map[int]*TaskGroup{}
+	m.nextID, m.nextGroupID = 1, 1
+
+	for _, def := range defs {
+		options := def.options()
+		store := ""
+		if product, err := ParseProductURL(options.URL, options.Domain); err == nil {
+			store = product.Hostname()
+		}
+		m.tasks[def.ID] = &Task{ID: def.ID, Options: options, store: store}
+		if def.ID >= m.nextID {
+			m.nextID = def.ID + 1
+		}
+	}
+	for _, group := range groups {
+		group := group
+		m.groups[group.ID] = &group
+		if group.ID >= m.nextGroupID {
+			m.nextGroupID = group.ID + 1
+		}
+	}
+	return nil
+}
+
+// saveLocked writes every task and group to the store. A failed save is logged
+// rather than failing the change the user just made.
+func (m *TaskManager) saveLocked() {
+	if m.config.Store == nil {
+		return
+	}
+
+	defs := make([]TaskDefinition, 0, len(m.tasks))
+	for _, task := range m.tasks {
+		defs = append(defs, definitionFromOptions(task.Options))
+	}
+	sort.Slice(defs, func(i, j int) bool {
+		return defs[i].ID < defs[j].ID
+	})
+
+	groups := make([]TaskGroup, 0, len(m.groups))
+	for _, group := range m.groups {
+		groups = append(groups, group.copy())
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].ID < groups[j].ID
+	})
+
+	if err := m.config.Store.Save(defs, groups); err != nil {
+		m.logger.Error("Error saving tasks", zap.Error(err))
+	}
+}
+
+// Shutdown stops every task and waits for them to exit, or for ctx to expire
+func (m *TaskManager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.cancel()
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
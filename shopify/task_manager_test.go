@@ -0,0 +1,228 @@
+package shopify_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"alin/packages/session"
+	"alin/packages/shopify"
+	"alin/packages/shopify/shopifytest"
+)
+
+// gate holds every request until it's opened, counting those held
+type gate struct {
+	open    chan struct{}
+	waiting int32
+}
+
+func newGate() *gate {
+	return &gate{open: make(chan struct{})}
+}
+
+func (g *gate) middleware(next session.Doer) session.Doer {
+	return session.DoerFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&g.waiting, 1)
+		defer atomic.AddInt32(&g.waiting, -1)
+		select {
+		case <-g.open:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		return next.Do(req)
+	})
+}
+
+// settle waits for the tasks to reach the gate, returning how many did
+func (g *gate) settle() int32 {
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&g.waiting) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Give a task that shouldn't get through the chance to
+	time.Sleep(200 * time.Millisecond)
+	return atomic.LoadInt32(&g.waiting)
+}
+
+func TestTaskManagerLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    shopify.TaskManagerConfig
+		sameStore bool
+		running   int32
+	}{
+		{"one per store", shopify.TaskManagerConfig{MaxPerStore: 1}, true, 1},
+		{"one per store, two stores", shopify.TaskManagerConfig{MaxPerStore: 1}, false, 2},
+		{"one at once", shopify.TaskManagerConfig{MaxConcurrent: 1}, false, 1},
+		{"no limits", shopify.TaskManagerConfig{}, true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := shopifytest.NewServer(shopifytest.HappyPath)
+			defer first.Close()
+			second := first
+			if !tt.sameStore {
+				second = shopifytest.NewServer(shopifytest.HappyPath)
+				defer second.Close()
+			}
+
+			g := newGate()
+			tt.config.Middleware = []session.Middleware{g.middleware}
+			m := shopify.NewTaskManager(tt.config)
+			defer m.Shutdown(context.Background())
+
+			var ids []int
+			for _, srv := range []*shopifytest.Server{first, second} {
+				id, err := m.Create(standInOptions(t, srv))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := m.Start(id); err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, id)
+			}
+
+			if running := g.settle(); running != tt.running {
+				t.Errorf("%d tasks sending requests, want %d", running, tt.running)
+			}
+			if tt.running == 1 {
+				waiting := 0
+				for _, info := range m.List() {
+					if info.Status.Message == "Waiting for a free slot" {
+						waiting++
+					}
+				}
+				if waiting != 1 {
+					t.Errorf("%d tasks waiting for a slot, want 1", waiting)
+				}
+			}
+
+			// The held task finishing frees its slot for the other
+			close(g.open)
+			for _, id := range ids {
+				info := waitForStatus(t, m, id, func(info shopify.TaskInfo) bool { return !info.Running })
+				if info.Status.State != shopify.StateSuccess {
+					t.Errorf("task %d ended %s, want Success", id, info.Status)
+				}
+			}
+			orders := len(first.Orders())
+			if !tt.sameStore {
+				orders += len(second.Orders())
+			}
+			if orders != 2 {
+				t.Errorf("%d orders, want 2", orders)
+			}
+		})
+	}
+}
+
+func TestTaskManagerPanic(t *testing.T) {
+	srv := shopifytest.NewServer(shopifytest.HappyPath)
+	defer srv.Close()
+
+	var panicked int32
+	crash := func(next session.Doer) session.Doer {
+		return session.DoerFunc(func(req *http.Request) (*http.Response, error) {
+			if atomic.CompareAndSwapInt32(&panicked, 0, 1) {
+				panic("middleware bug")
+			}
+			return next.Do(req)
+		})
+	}
+	// One slot, so the crashed run has to give it back for the next one to start
+	m := shopify.NewTaskManager(shopify.TaskManagerConfig{MaxConcurrent: 1, Middleware: []session.Middleware{crash}})
+	defer m.Shutdown(context.Background())
+
+	id, err := m.Create(standInOptions(t, srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(id); err != nil {
+		t.Fatal(err)
+	}
+	info := waitForStatus(t, m, id, func(info shopify.TaskInfo) bool { return !info.Running })
+	if info.Status.State != shopify.StateError || !strings.Contains(info.Status.Message, "middleware bug") {
+		t.Fatalf("crashed task ended %s, want an error naming the panic", info.Status)
+	}
+
+	if err := m.Start(id); err != nil {
+		t.Fatal(err)
+	}
+	info = waitForStatus(t, m, id, func(info shopify.TaskInfo) bool { return !info.Running })
+	if info.Status.State != shopify.StateSuccess || len(srv.Orders()) != 1 {
+		t.Errorf("task started again after a crash ended %s with %d orders, want Success with 1", info.Status, len(srv.Orders()))
+	}
+}
+
+func TestTaskManagerShutdown(t *testing.T) {
+	srv := shopifytest.NewServer(shopifytest.HappyPath)
+	defer srv.Close()
+
+	g := newGate()
+	m := shopify.NewTaskManager(shopify.TaskManagerConfig{Middleware: []session.Middleware{g.middleware}})
+	id, err := m.Create(standInOptions(t, srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(id); err != nil {
+		t.Fatal(err)
+	}
+	if running := g.settle(); running != 1 {
+		t.Fatalf("%d tasks sending requests, want 1", running)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Shutdown returned, so the task has already exited
+	info, err := m.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Running || info.Status.State != shopify.StateStopped {
+		t.Errorf("task %s after shutdown, running %v, want it stopped", info.Status, info.Running)
+	}
+	if err := m.Start(id); err != shopify.ErrManagerStopped {
+		t.Errorf("Start after shutdown = %v, want ErrManagerStopped", err)
+	}
+}
+
+// A task that ignores being stopped doesn't hold Shutdown up past its deadline
+func TestTaskManagerShutdownDeadline(t *testing.T) {
+	srv := shopifytest.NewServer(shopifytest.HappyPath)
+	defer srv.Close()
+
+	release := make(chan struct{})
+	defer close(release)
+	var held int32
+	stuck := func(next session.Doer) session.Doer {
+		return session.DoerFunc(func(req *http.Request) (*http.Response, error) {
+			atomic.StoreInt32(&held, 1)
+			<-release
+			return next.Do(req)
+		})
+	}
+	m := shopify.NewTaskManager(shopify.TaskManagerConfig{Middleware: []session.Middleware{stuck}})
+	id, err := m.Create(standInOptions(t, srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(id); err != nil {
+		t.Fatal(err)
+	}
+	for atomic.LoadInt32(&held) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := m.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown = %v, want DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,165 @@
+package shopify
+
+import (
+	"alin/packages/shopify/data_handling"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Bump when the file layout changes and add a migration in TaskStore.Load
+const taskFileVersion = 1
+
+// TaskDefinition is everything needed to recreate a task. Card details are never
+// written here, only the name of the profile.
+type TaskDefinition struct {
+	ID               int                          `json:"id"`
+	URL              string                       `json:"url"`
+	Domain           string                       `json:"domain,omitempty"`
+	VariantID        string                       `json:"variantId,omitempty"`
+	Size             string                       `json:"size"`
+	Profile          string                       `json:"profile"`
+	ShippingStrategy string                       `json:"shippingStrategy,omitempty"`
+	StartAt          *time.Time                   `json:"startAt,omitempty"`
+	PrewarmLeadMs    int64                        `json:"prewarmLeadMs,omitempty"`
+	MaxAttempts      int                          `json:"maxAttempts,omitempty"`
+	UseProxy         bool                         `json:"useProxy"`
+	Proxy            data_handling.ProxyDefiniton `json:"proxy"`
+	BaseURL          string                       `json:"baseUrl,omitempty"`
+	CACerts          []string                     `json:"caCerts,omitempty"`
+}
+
+type taskFile struct {
+	Version int              `json:"version"`
+	Tasks   []TaskDefinition `json:"tasks"`
+	Groups  []TaskGroup      `json:"groups"`
+}
+
+func definitionFromOptions(options data_handling.Options) TaskDefinition {
+	def := TaskDefinition{
+		ID:               options.TaskID,
+		URL:              options.URL,
+		Domain:           options.Domain,
+		VariantID:        options.VariantID,
+		Size:             options.Size,
+		Profile:          options.ProfileName,
+		ShippingStrategy: options.ShippingStrategy,
+		PrewarmLeadMs:    options.PrewarmLead.Milliseconds(),
+		MaxAttempts:      options.MaxAttempts,
+		UseProxy:         options.UseProxy,
+		Proxy:            options.Proxy,
+		BaseURL:          options.BaseURL,
+		CACerts:          options.CACerts,
+	}
+	if !options.StartAt.IsZero() {
+		startAt := options.StartAt
+		def.StartAt = &startAt
+	}
+	return def
+}
+
+func (def TaskDefinition) options() data_handling.Options {
+	options := data_handling.Options{
+		TaskID:           def.ID,
+		URL:              def.URL,
+		Domain:           def.Domain,
+		VariantID:        def.VariantID,
+		Size:             def.Size,
+		ProfileName:      def.Profile,
+		ShippingStrategy: def.ShippingStrategy,
+		PrewarmLead:      time.Duration(def.PrewarmLeadMs) * time.Millisecond,
+		MaxAttempts:      def.MaxAttempts,
+		UseProxy:         def.UseProxy,
+		Proxy:            def.Proxy,
+		BaseURL:          def.BaseURL,
+		CACerts:          def.CACerts,
+	}
+	if def.StartAt != nil {
+		options.StartAt = *def.StartAt
+	}
+	return options
+}
+
+// TaskStore keeps task definitions and groups in a versioned JSON file
+type TaskStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// Constructor
+func NewTaskStore(path string) *TaskStore {
+	return &TaskStore{path: path}
+}
+
+// DefaultTaskStore stores tasks in the app data directory
+func DefaultTaskStore() (*TaskStore, error) {
+	path, err := data_handling.AppDataPath("tasks.json")
+	if err != nil {
+		return nil, err
+	}
+	return NewTaskStore(path), nil
+}
+
+// Load reads the file. A missing file is an empty store, not an error.
+func (s *TaskStore) Load() ([]TaskDefinition, []TaskGroup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var file taskFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, nil, fmt.Errorf("Could not read %s: %w", s.path, err)
+	}
+	if file.Version > taskFileVersion {
+		return nil, nil, fmt.Errorf("%s was written by a newer version (file version %d)", s.path, file.Version)
+	}
+
+	return file.Tasks, file.Groups, nil
+}
+
+// Save replaces the file, see writeFileAtomic
+func (s *TaskStore) Save(tasks []TaskDefinition, groups []TaskGroup) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(taskFile{
+		Version: taskFileVersion,
+		Tasks:   tasks,
+		Groups:  groups,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic replaces the file at path, writing to a temporary file first so
+// a crash can't leave half a file behind. The file is only readable by the user.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
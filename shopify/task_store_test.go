@@ -0,0 +1,83 @@
+package shopify_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"alin/packages/shopify"
+	"alin/packages/shopify/data_handling"
+	"alin/packages/shopify/shopifytest"
+)
+
+const testProductURL = "https://www.routeone.co.uk/products/dunk-low"
+
+func newPersistedManager(t *testing.T, path string) *shopify.TaskManager {
+	t.Helper()
+	m := shopify.NewTaskManager(shopify.TaskManagerConfig{
+		Store:    shopify.NewTaskStore(path),
+		Profiles: data_handling.StaticProfiles{"Test": shopifytest.Profile()},
+	})
+	t.Cleanup(func() { m.Shutdown(context.Background()) })
+	return m
+}
+
+func TestTaskStoreRejectsInlineProfile(t *testing.T) {
+	m := newPersistedManager(t, filepath.Join(t.TempDir(), "tasks.json"))
+
+	_, err := m.Create(data_handling.Options{URL: testProductURL, Size: "UK 9", Profile: shopifytest.Profile()})
+	if !errors.Is(err, shopify.ErrInlineProfile) {
+		t.Fatalf("Create with an inline profile = %v, want ErrInlineProfile", err)
+	}
+	if len(m.List()) != 0 {
+		t.Errorf("rejected task was added")
+	}
+
+	// Kept in memory only, an inline profile is fine
+	memory := shopify.NewTaskManager(shopify.TaskManagerConfig{})
+	defer memory.Shutdown(context.Background())
+	if _, err := memory.Create(data_handling.Options{URL: testProductURL, Size: "UK 9", Profile: shopifytest.Profile()}); err != nil {
+		t.Errorf("Create without a task store: %v", err)
+	}
+}
+
+func TestTaskStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.json")
+	m := newPersistedManager(t, path)
+
+	startAt := time.Date(2030, time.January, 2, 10, 0, 0, 0, time.UTC)
+	options := data_handling.Options{
+		URL:              testProductURL,
+		Size:             "UK 9",
+		ProfileName:      "Test",
+		ShippingStrategy: "cheapest",
+		StartAt:          startAt,
+		PrewarmLead:      5 * time.Second,
+		// Never reach the real store, the task only waits for StartAt here
+		BaseURL: "https://localhost:1",
+	}
+	id, err := m.Create(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newPersistedManager(t, path)
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := loaded.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.URL != options.URL || info.Size != options.Size || !info.StartAt.Equal(startAt) {
+		t.Errorf("loaded task %+v doesn't match %+v", info, options)
+	}
+
+	// The loaded task resolves its profile by name again and starts
+	if err := loaded.Start(id); err != nil {
+		t.Fatalf("Start loaded task: %v", err)
+	}
+	loaded.Stop(id)
+}